@@ -1,6 +1,14 @@
 package main
 
-import "log"
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"log"
+	"path/filepath"
+	"sort"
+	"time"
+)
 
 type acceptorInstance struct {
 	instanceID     int
@@ -10,18 +18,125 @@ type acceptorInstance struct {
 }
 
 type acceptor struct {
-	instances     map[int]*acceptorInstance
-	instanceGroup *InstanceGroup
+	instances           map[int]*acceptorInstance
+	instanceGroup       *InstanceGroup
+	wal                 *wal
+	compactedInstanceID int // 这个instanceID及之前的值已经被选定并进入快照，不再参与投票
+	maxAcceptedID       int // 接受过值的最大instanceID
+	// 最近接受的选主值，这个值可能已经被选定而本节点还没有学习到，租期内拒绝其他节点在它之后的instance上发起
+	leaseNodeID     int
+	leaseInstanceID int
+	leaseExpireTime time.Time
+	// 重启前可能接受过选主的值，已经无法知道是谁，到期之前不参与投票
+	restartExpireTime time.Time
 }
 
 func newAcceptor(instanceGroup *InstanceGroup) *acceptor {
 	a := &acceptor{instanceGroup: instanceGroup}
 	a.instances = make(map[int]*acceptorInstance)
 
+	dataDir := instanceGroup.getDataDir()
+	if dataDir == "" {
+		return a
+	}
+
+	w, err := openWAL(filepath.Join(dataDir, "acceptor.wal"))
+	if err != nil {
+		log.Printf("acceptor: %d open wal error: %v", instanceGroup.getNodeID(), err)
+		return nil
+	}
+
+	err = w.replay(func(data []byte) error {
+		inst, err := unserializeAcceptorInstance(data)
+		if err != nil {
+			return err
+		}
+		a.instances[inst.instanceID] = inst
+		if inst.acceptBallot != 0 && inst.instanceID > a.maxAcceptedID {
+			a.maxAcceptedID = inst.instanceID
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("acceptor: %d replay wal error: %v", instanceGroup.getNodeID(), err)
+		w.close()
+		return nil
+	}
+	a.wal = w
+	if len(a.instances) > 0 {
+		a.restartExpireTime = instanceGroup.now().Add(masterLeaseTime + masterLeaseMargin)
+	}
+
+	log.Printf("acceptor: %d load %d instances from wal", instanceGroup.getNodeID(), len(a.instances))
+
 	return a
 }
 
+// persist 在回复proposer之前把承诺和接受的状态落盘，保证重启后不会违背之前的承诺
+func (a *acceptor) persist(inst *acceptorInstance) bool {
+	if a.wal == nil {
+		return true
+	}
+
+	err := a.wal.append(serializeAcceptorInstance(inst))
+	if err != nil {
+		log.Printf("acceptor: %d persist instanceID(%d) error: %v", a.instanceGroup.getNodeID(), inst.instanceID, err)
+		return false
+	}
+
+	return true
+}
+
+// isLeased 其他节点持有master租期时不回复，master在租期内才能确定没有自己不知道的值被选定。
+// 发起者收不到回复，等重试的时候租期可能已经过了。fast paxos下所有节点都直接提交，不做限制
+func (a *acceptor) isLeased(msg message) bool {
+	if a.instanceGroup.isFastPaxos() {
+		return false
+	}
+
+	now := a.instanceGroup.now()
+	if now.Before(a.restartExpireTime) {
+		return true
+	}
+	if msg.from != a.leaseNodeID && msg.instanceID > a.leaseInstanceID && now.Before(a.leaseExpireTime) {
+		return true
+	}
+
+	master, version, expireTime := a.instanceGroup.master.getLease()
+	return master != 0 && msg.from != master && msg.instanceID > version && now.Before(expireTime.Add(masterLeaseMargin))
+}
+
+// observeLease 接受了选主值时记录下来，不等学习到就开始拒绝其他节点，过期的选主值学习到也不会生效，不需要记录
+func (a *acceptor) observeLease(instanceID int, value string) {
+	info, ok := masterInfoOf(value)
+	if !ok {
+		return
+	}
+
+	_, version, _ := a.instanceGroup.master.getLease()
+	if info.version < version {
+		return
+	}
+
+	now := a.instanceGroup.now()
+	if instanceID < a.leaseInstanceID && now.Before(a.leaseExpireTime) {
+		return
+	}
+	a.leaseNodeID = info.nodeID
+	a.leaseInstanceID = instanceID
+	a.leaseExpireTime = now.Add(masterLeaseTime + masterLeaseMargin)
+}
+
 func (a *acceptor) onPrepare(msg message) {
+	if msg.instanceID <= a.compactedInstanceID {
+		log.Printf("acceptor: %d ignore prepare from(%d) compacted instanceID(%d)", a.instanceGroup.getNodeID(), msg.from, msg.instanceID)
+		return
+	}
+	if a.isLeased(msg) {
+		log.Printf("acceptor: %d ignore prepare from(%d) instanceID(%d) in other's lease", a.instanceGroup.getNodeID(), msg.from, msg.instanceID)
+		return
+	}
+
 	inst := a.instances[msg.instanceID]
 	if inst == nil {
 		inst = &acceptorInstance{}
@@ -38,6 +153,11 @@ func (a *acceptor) onPrepare(msg message) {
 	m.acceptValue = inst.acceptValue
 	if msg.proposalBallot > inst.promisedBallot {
 		log.Printf("acceptor: %d pass prepare from(%d) instanceID(%d) proposalID(%d) promisedBallot(%d) acceptBallot(%d)", a.instanceGroup.getNodeID(), msg.from, msg.instanceID, msg.proposalBallot, inst.promisedBallot, inst.acceptBallot)
+		newInst := *inst
+		newInst.promisedBallot = msg.proposalBallot
+		if !a.persist(&newInst) {
+			return
+		}
 		inst.promisedBallot = msg.proposalBallot
 	} else {
 		log.Printf("acceptor: %d reject prepare from(%d) instanceID(%d) proposalID(%d) promisedBallot(%d) acceptBallot(%d)", a.instanceGroup.getNodeID(), msg.from, msg.instanceID, msg.proposalBallot, inst.promisedBallot, inst.acceptBallot)
@@ -48,8 +168,12 @@ func (a *acceptor) onPrepare(msg message) {
 }
 
 func (a *acceptor) onAccept(msg message) {
-	inst := a.instances[msg.instanceID]
-	if inst == nil {
+	if msg.instanceID <= a.compactedInstanceID {
+		log.Printf("acceptor: %d ignore accept from(%d) compacted instanceID(%d)", a.instanceGroup.getNodeID(), msg.from, msg.instanceID)
+		return
+	}
+	if a.isLeased(msg) {
+		log.Printf("acceptor: %d ignore accept from(%d) instanceID(%d) in other's lease", a.instanceGroup.getNodeID(), msg.from, msg.instanceID)
 		return
 	}
 
@@ -59,27 +183,141 @@ func (a *acceptor) onAccept(msg message) {
 	m.from = a.instanceGroup.getNodeID()
 	m.proposalBallot = msg.proposalBallot
 
-	if msg.proposalBallot >= inst.promisedBallot {
+	inst := a.instances[msg.instanceID]
+	if inst == nil {
+		// fast round没有prepare阶段，相当于所有acceptor已经承诺了fastBallot。
+		// 其他没有承诺过的instance马上拒绝，proposer不用等到超时就重新prepare
+		if msg.proposalBallot != fastBallot {
+			log.Printf("acceptor: %d reject accept from(%d) unprepared instanceID(%d) proposalID(%d)", a.instanceGroup.getNodeID(), msg.from, msg.instanceID, msg.proposalBallot)
+			m.rejectBallot = msg.proposalBallot
+			a.instanceGroup.response(msg.from, m)
+			return
+		}
+		inst = &acceptorInstance{instanceID: msg.instanceID}
+		a.instances[inst.instanceID] = inst
+	}
+
+	// 只接受本instance上承诺过的ballot（prepare或者multi-paxos的提前承诺）。比承诺的大说明proposer
+	// 跳过了本instance的prepare，不知道这里已经接受过的值，接受的话可能覆盖已经选定的值
+	pass := msg.proposalBallot == inst.promisedBallot
+	// fast round相当于所有instance一开始都承诺了fastBallot，只接受收到的第一个值，不同的值视为冲突
+	if msg.proposalBallot == fastBallot {
+		pass = inst.promisedBallot <= fastBallot && (inst.acceptBallot == 0 || inst.acceptValue == a.storedValue(msg.acceptValue))
+	}
+
+	if pass {
 		log.Printf("acceptor: %d pass accept from(%d) instanceID(%d) proposalID(%d) promisedBallot(%d) acceptBallot(%d) oldValue(%s) newValue(%s)", a.instanceGroup.getNodeID(), msg.from, msg.instanceID, msg.proposalBallot, inst.promisedBallot, inst.acceptBallot, inst.acceptValue, msg.acceptValue)
-		inst.acceptValue = msg.acceptValue
-		inst.acceptBallot = msg.proposalBallot
-		inst.promisedBallot = msg.proposalBallot
+		acceptedInst := &acceptorInstance{instanceID: msg.instanceID, promisedBallot: msg.proposalBallot, acceptBallot: msg.proposalBallot, acceptValue: a.storedValue(msg.acceptValue)}
+		if !a.persist(acceptedInst) {
+			return
+		}
+		a.instances[acceptedInst.instanceID] = acceptedInst
+		inst = acceptedInst
+		if inst.instanceID > a.maxAcceptedID {
+			a.maxAcceptedID = inst.instanceID
+		}
+		a.observeLease(inst.instanceID, msg.acceptValue)
 
 		m.acceptBallot = inst.acceptBallot
 		m.acceptValue = inst.acceptValue
+		// 选定的值是选主时，master执行到多数派接受过的最大instance之后才能直接读本地，
+		// 在此之前接受的值可能已经被其他节点选定
+		m.endInstanceID = a.maxAcceptedID
+
+		// multi-paxos 中的优化，省去了连续成功后的prepare阶段，并发提交时需要覆盖整个窗口。
+		// 各个节点配置的窗口可以不同，按上限maxPipelineWindow承诺，覆盖任何proposer的窗口。
+		// fast paxos下提前承诺会拒绝后面的fast round，所以不做
+		for i := 1; i <= maxPipelineWindow && !a.instanceGroup.isFastPaxos(); i++ {
+			if a.instances[inst.instanceID+i] != nil {
+				continue
+			}
 
-		if a.instances[inst.instanceID+1] == nil {
-			// multi-paxos 中的优化，省去了连续成功后的prepare阶段
 			newInst := &acceptorInstance{}
-			newInst.instanceID = msg.instanceID + 1
+			newInst.instanceID = msg.instanceID + i
 			newInst.promisedBallot = msg.proposalBallot
-			a.instances[newInst.instanceID] = newInst
+			if a.persist(newInst) {
+				a.instances[newInst.instanceID] = newInst
+			}
 		}
 
 	} else {
 		log.Printf("acceptor: %d reject accept from(%d) instanceID(%d) proposalID(%d) promisedBallot(%d) acceptBallot(%d) oldValue(%s) newValue(%s)", a.instanceGroup.getNodeID(), msg.from, msg.instanceID, msg.proposalBallot, inst.promisedBallot, inst.acceptBallot, inst.acceptValue, msg.acceptValue)
+		// 承诺的ballot比较小时也要回复非0的rejectBallot，proposer据此用更大的ballot重新prepare
 		m.rejectBallot = inst.promisedBallot
+		if m.rejectBallot < msg.proposalBallot {
+			m.rejectBallot = msg.proposalBallot
+		}
 	}
 
 	a.instanceGroup.response(msg.from, m)
 }
+
+// storedValue 见证者只保存值的摘要，回复prepare时proposer据此知道需要从其他成员拿到完整的值
+func (a *acceptor) storedValue(value string) string {
+	if !a.instanceGroup.node.isWitness() {
+		return value
+	}
+
+	return witnessDigest(value)
+}
+
+func witnessDigest(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// compact 删除instanceID及之前的状态，这些instance已经被本节点学习并进入快照
+func (a *acceptor) compact(instanceID int) {
+	if instanceID <= a.compactedInstanceID {
+		return
+	}
+	a.compactedInstanceID = instanceID
+
+	var ids []int
+	for k := range a.instances {
+		if k <= instanceID {
+			delete(a.instances, k)
+		} else {
+			ids = append(ids, k)
+		}
+	}
+
+	if a.wal == nil {
+		return
+	}
+
+	sort.Ints(ids)
+	records := make([][]byte, 0, len(ids))
+	for _, id := range ids {
+		records = append(records, serializeAcceptorInstance(a.instances[id]))
+	}
+
+	err := a.wal.rewrite(records)
+	if err != nil {
+		log.Printf("acceptor: %d compact wal instanceID(%d) error: %v", a.instanceGroup.getNodeID(), instanceID, err)
+	}
+}
+
+func serializeAcceptorInstance(inst *acceptorInstance) []byte {
+	buf := make([]byte, 12+len(inst.acceptValue))
+	binary.LittleEndian.PutUint32(buf[0:], uint32(inst.instanceID))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(inst.promisedBallot))
+	binary.LittleEndian.PutUint32(buf[8:], uint32(inst.acceptBallot))
+	copy(buf[12:], inst.acceptValue)
+
+	return buf
+}
+
+func unserializeAcceptorInstance(buf []byte) (*acceptorInstance, error) {
+	if len(buf) < 12 {
+		return nil, errBadWALRecord
+	}
+
+	inst := &acceptorInstance{}
+	inst.instanceID = int(binary.LittleEndian.Uint32(buf[0:]))
+	inst.promisedBallot = int(binary.LittleEndian.Uint32(buf[4:]))
+	inst.acceptBallot = int(binary.LittleEndian.Uint32(buf[8:]))
+	inst.acceptValue = string(buf[12:])
+
+	return inst, nil
+}
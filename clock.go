@@ -0,0 +1,31 @@
+package main
+
+import "time"
+
+// clock 时间来源，正常运行时是系统时间，模拟模式下由模拟器推进虚拟时间
+type clock interface {
+	now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) now() time.Time {
+	return time.Now()
+}
+
+// virtualClock 只在模拟器调用advance时前进，所有节点共用一个
+type virtualClock struct {
+	current time.Time
+}
+
+func newVirtualClock() *virtualClock {
+	return &virtualClock{current: time.Unix(0, 0)}
+}
+
+func (c *virtualClock) now() time.Time {
+	return c.current
+}
+
+func (c *virtualClock) advance(d time.Duration) {
+	c.current = c.current.Add(d)
+}
@@ -10,21 +10,41 @@ const (
 	PushLearn
 	PullLearnRequest
 	PullLearnResponse
+	SnapshotChunk
+	ReadIndexRequest
+	ReadIndexResponse
+	ForwardRequest
+	ForwardResponse
+	EPaxosPreAccept
+	EPaxosPreAcceptReply
+	EPaxosAccept
+	EPaxosAcceptReply
+	EPaxosCommit
+	EPaxosPrepare
+	EPaxosPrepareReply
+	EPaxosExecuted
 	Closed
 )
 
 const (
-	PromisedTimeout int = iota + 1
-	AcceptedTimeout
-	PullLearnTimeout
+	PullLearnTimeout int = iota + 1
+	SnapshotTimeout
 )
 
+// proposerTimerID 每个进行中的instance一个超时定时器，用负数跟上面的定时器区分开
+func proposerTimerID(instanceID int) int {
+	return -instanceID
+}
+
 type message struct {
-	typ            int
-	from           int
-	instanceID     int
-	proposalBallot int
-	rejectBallot   int
-	acceptBallot   int
-	acceptValue    string
+	typ             int
+	from            int
+	instanceGroupID int
+	seq             int // 请求序号，用于匹配请求跟回复
+	instanceID      int
+	endInstanceID   int
+	proposalBallot  int
+	rejectBallot    int
+	acceptBallot    int
+	acceptValue     string
 }
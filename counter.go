@@ -1,16 +1,138 @@
 package main
 
+import "fmt"
+
+const (
+	quorumPhase1 int = iota + 1
+	quorumPhase2
+	quorumRead
+	quorumFast
+)
+
+// quorumConfig 每个节点的投票权重以及两个阶段各自需要的权重，为0时使用多数派。
+// 两个阶段的多数派必须相交，即 phase1 + phase2 > 总权重。
+// fast paxos中任意一个phase1多数派跟任意两个fast多数派必须相交，即 phase1 + 2*fast > 2*总权重
+type quorumConfig struct {
+	weights   map[int]int
+	phase1    int
+	phase2    int
+	fast      int
+	witnesses map[int]bool // 只保存值摘要的成员，任何phase2多数派都必须包含保存完整值的成员
+}
+
+func (qc *quorumConfig) getWeight(id int) int {
+	if weight, ok := qc.weights[id]; ok {
+		return weight
+	}
+
+	return 1
+}
+
+func (qc *quorumConfig) isWitness(id int) bool {
+	return qc.witnesses[id]
+}
+
+func (qc *quorumConfig) getTotalWeight(members map[int]string) int {
+	var total int
+	for id := range members {
+		total += qc.getWeight(id)
+	}
+
+	return total
+}
+
+func (qc *quorumConfig) getQuorum(phase int, totalWeight int) int {
+	phase1 := qc.phase1
+	if phase1 <= 0 {
+		phase1 = totalWeight/2 + 1
+	}
+	phase2 := qc.phase2
+	if phase2 <= 0 {
+		phase2 = totalWeight/2 + 1
+	}
+
+	switch phase {
+	case quorumPhase1:
+		return phase1
+	case quorumPhase2:
+		return phase2
+	case quorumFast:
+		if qc.fast > 0 {
+			return qc.fast
+		}
+		return (2*totalWeight-phase1)/2 + 1
+	default:
+		// 读需要跟所有第二阶段的多数派相交，才能看到所有已经完成的写
+		return totalWeight - phase2 + 1
+	}
+}
+
+func (qc *quorumConfig) validate(members map[int]string) error {
+	total := qc.getTotalWeight(members)
+	phase1 := qc.getQuorum(quorumPhase1, total)
+	phase2 := qc.getQuorum(quorumPhase2, total)
+
+	if phase1 > total || phase2 > total {
+		return fmt.Errorf("quorum phase1(%d) phase2(%d) larger than total weight(%d)", phase1, phase2, total)
+	}
+	if phase1+phase2 <= total {
+		return fmt.Errorf("quorum phase1(%d) phase2(%d) do not intersect with total weight(%d)", phase1, phase2, total)
+	}
+
+	fast := qc.getQuorum(quorumFast, total)
+	if fast > total || phase1+2*fast <= 2*total {
+		return fmt.Errorf("quorum phase1(%d) fast(%d) invalid with total weight(%d)", phase1, fast, total)
+	}
+
+	var witnessWeight int
+	for id := range members {
+		if qc.isWitness(id) {
+			witnessWeight += qc.getWeight(id)
+		}
+	}
+	if witnessWeight >= phase2 {
+		return fmt.Errorf("quorum phase2(%d) can be formed by witnesses with weight(%d)", phase2, witnessWeight)
+	}
+
+	return nil
+}
+
 type counter struct {
-	nodeCount int
-	passes    map[int]int
-	rejects   map[int]int
+	nodeCount   int
+	members     map[int]string // 只统计成员的投票
+	weights     map[int]int
+	totalWeight int
+	quorum      int
+	passes      map[int]int
+	rejects     map[int]int
+}
+
+func (c *counter) setMembers(members map[int]string, qc *quorumConfig) {
+	c.members = members
+	c.nodeCount = len(members)
+	c.weights = make(map[int]int, len(members))
+	for id := range members {
+		c.weights[id] = qc.getWeight(id)
+	}
+	c.totalWeight = qc.getTotalWeight(members)
+}
+
+func (c *counter) isMember(id int) bool {
+	_, ok := c.members[id]
+	return ok
 }
 
 func (c *counter) addReject(id int, rejectN int) {
+	if !c.isMember(id) {
+		return
+	}
 	c.rejects[id] = rejectN
 }
 
 func (c *counter) addPass(id int) {
+	if !c.isMember(id) {
+		return
+	}
 	c.passes[id] = 1
 }
 
@@ -25,19 +147,34 @@ func (c *counter) getMaxRejectN() int {
 	return rejectN
 }
 
+func (c *counter) getWeight(votes map[int]int) int {
+	var weight int
+	for id := range votes {
+		weight += c.weights[id]
+	}
+
+	return weight
+}
+
+func (c *counter) getPassWeight() int {
+	return c.getWeight(c.passes)
+}
+
 func (c *counter) isPassedOnThisRound() bool {
-	return len(c.passes) >= c.nodeCount/2+1
+	return c.getWeight(c.passes) >= c.quorum
 }
 
+// isRejectedOnThisRound 剩下的票已经不可能达到quorum
 func (c *counter) isRejectedOnThisRound() bool {
-	return len(c.rejects) >= c.nodeCount/2+1
+	return c.getWeight(c.rejects) > c.totalWeight-c.quorum
 }
 
 func (c *counter) isAllReceiveOnThisRound() bool {
 	return len(c.passes)+len(c.rejects) == c.nodeCount
 }
 
-func (c *counter) startNewRound() {
+func (c *counter) startNewRound(quorum int) {
+	c.quorum = quorum
 	c.passes = make(map[int]int)
 	c.rejects = make(map[int]int)
 }
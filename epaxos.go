@@ -0,0 +1,1140 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	epaxosNone int = iota
+	epaxosPreAccepted
+	epaxosAccepted
+	epaxosCommitted
+	epaxosExecuted
+)
+
+// 发起者所处的阶段
+const (
+	epaxosPhaseNone int = iota
+	epaxosPhasePreAccept
+	epaxosPhaseAccept
+	epaxosPhasePrepare
+)
+
+// epaxosFastTimeout fast path需要所有成员的回复都跟发起时一致，有节点不可用时等这么久就走accept阶段
+const epaxosFastTimeout = time.Millisecond * 200
+
+// epaxosRecoveryTimeout 依赖的instance或者自己发起的instance这么久没有提交，就由本节点发起恢复
+const epaxosRecoveryTimeout = time.Second * 2
+
+var errBadEPaxosInstance = errors.New("bad epaxos instance")
+
+type epaxosInstanceID struct {
+	replica int
+	slot    int
+}
+
+type epaxosInstance struct {
+	id           epaxosInstanceID
+	ballot       int
+	acceptBallot int // 进入accepted状态时的ballot，恢复时选最大的
+	status       int
+	seq          int
+	deps         map[int]int // 每个replica上跟本命令冲突的最大slot
+	command      string      // 为空表示恢复时提交的noop
+
+	// 以下只在发起者上使用
+	phase      int
+	counter    counter
+	changed    bool              // preAccept的回复跟发起时的属性不一致，不能走fast path
+	recovery   []*epaxosInstance // 恢复时收集到的各节点状态
+	updateTime time.Time         // 进入当前阶段的时间
+	request    *commitRequest    // 本节点上等待结果的请求
+}
+
+// keyedStatemachine 能从命令中取出冲突key的状态机，只有同一个key的命令需要排序。
+// 没有实现的状态机所有命令都互相冲突
+type keyedStatemachine interface {
+	getKey(value string) string
+}
+
+// epaxos Egalitarian Paxos，每个节点都可以在自己的slot上发起命令，不需要master。
+// 命令在preAccept阶段收集跟它冲突的命令作为依赖，所有成员的回复都没有增加依赖时一个来回就提交，
+// 否则再用多数派accept合并后的依赖。执行时按依赖图的强连通分量排序，同一个分量内按seq排序。
+// 系统值仍然走proposer，因为它们需要跟learner的instanceID一起全局有序
+type epaxos struct {
+	instanceGroup *InstanceGroup
+	sm            statemachine
+	sequence      int
+	nextSlot      int
+	instances     map[epaxosInstanceID]*epaxosInstance
+	conflicts     map[string]map[int]int // 每个key在每个replica上的最大slot
+	maxSeq        map[string]int         // 每个key上见过的最大seq
+	leading       map[epaxosInstanceID]*epaxosInstance
+	committed     map[epaxosInstanceID]*epaxosInstance // 已经提交还没有执行的instance
+	waiting       map[epaxosInstanceID]time.Time       // 执行时等待提交的依赖，超时后发起恢复
+	commitQueue   []*commitRequest
+	commitLock    sync.Mutex // commit协程跟instance协程保护锁
+	wal           *wal
+	executedSlots map[int]int         // 每个replica上这个slot及之前的instance已经进入快照，从内存跟日志中删除
+	peerExecuted  map[int]map[int]int // 其他成员上报的每个replica上连续执行完的slot
+}
+
+func newEPaxos(instanceGroup *InstanceGroup, sm statemachine) *epaxos {
+	e := &epaxos{instanceGroup: instanceGroup, sm: sm, nextSlot: 1}
+	e.instances = make(map[epaxosInstanceID]*epaxosInstance)
+	e.conflicts = make(map[string]map[int]int)
+	e.maxSeq = make(map[string]int)
+	e.leading = make(map[epaxosInstanceID]*epaxosInstance)
+	e.committed = make(map[epaxosInstanceID]*epaxosInstance)
+	e.waiting = make(map[epaxosInstanceID]time.Time)
+	e.executedSlots = make(map[int]int)
+	e.peerExecuted = make(map[int]map[int]int)
+
+	dataDir := instanceGroup.getDataDir()
+	if dataDir == "" {
+		return e
+	}
+
+	executed, err := e.loadSnapshot(filepath.Join(dataDir, "epaxos.snapshot"))
+	if err != nil {
+		log.Printf("epaxos: %d load snapshot error: %v", instanceGroup.getNodeID(), err)
+		return nil
+	}
+
+	w, err := openWAL(filepath.Join(dataDir, "epaxos.wal"))
+	if err != nil {
+		log.Printf("epaxos: %d open wal error: %v", instanceGroup.getNodeID(), err)
+		return nil
+	}
+
+	// 快照之后的日志重放到状态机，快照时已经执行过的命令不再执行
+	err = w.replay(func(data []byte) error {
+		inst, err := unserializeEPaxosInstance(string(data))
+		if err != nil {
+			return errBadWALRecord
+		}
+		if e.isCompacted(inst.id) {
+			return nil
+		}
+		if inst.status >= epaxosCommitted {
+			inst.status = epaxosCommitted
+			if executed[inst.id] {
+				inst.status = epaxosExecuted
+			}
+		}
+		e.instances[inst.id] = inst
+		return nil
+	})
+	if err != nil {
+		log.Printf("epaxos: %d replay wal error: %v", instanceGroup.getNodeID(), err)
+		w.close()
+		return nil
+	}
+	e.wal = w
+
+	for _, inst := range e.instances {
+		e.recordConflict(inst)
+		if inst.status == epaxosCommitted {
+			e.committed[inst.id] = inst
+		}
+	}
+	e.execute()
+
+	log.Printf("epaxos: %d load %d instances from wal", instanceGroup.getNodeID(), len(e.instances))
+
+	return e
+}
+
+// commit 把命令放入队列，instance协程在本节点的下一个slot上发起
+func (e *epaxos) commit(ctx context.Context, val string) (string, error) {
+	// instance序列化后带着每个成员的依赖，需要能放进一个网络帧
+	limit := e.instanceGroup.getMaxValueSize() - 28 - 8*len(e.instanceGroup.membership.getLatestNodes())
+	if len(val) > limit {
+		log.Printf("epaxos: %d value size(%d) exceeds limit(%d)", e.instanceGroup.getNodeID(), len(val), limit)
+		return "", errValueTooLarge
+	}
+
+	req := &commitRequest{value: val, result: make(chan string, 1)}
+
+	e.commitLock.Lock()
+	e.commitQueue = append(e.commitQueue, req)
+	e.commitLock.Unlock()
+
+	select {
+	case result := <-req.result:
+		return result, nil
+	case <-ctx.Done():
+		e.commitLock.Lock()
+		req.canceled = true
+		for i, r := range e.commitQueue {
+			if r == req {
+				e.commitQueue = append(e.commitQueue[:i:i], e.commitQueue[i+1:]...)
+				break
+			}
+		}
+		e.commitLock.Unlock()
+		return "", contextError(ctx)
+	}
+}
+
+// update 在instance协程中调用，发起排队的命令并处理超时
+func (e *epaxos) update() {
+	e.commitLock.Lock()
+	queue := e.commitQueue
+	e.commitQueue = nil
+	e.commitLock.Unlock()
+
+	for _, req := range queue {
+		e.propose(req)
+	}
+
+	now := e.instanceGroup.now()
+	for id, inst := range e.leading {
+		if inst.phase == epaxosPhasePreAccept && now.Sub(inst.updateTime) > epaxosFastTimeout && inst.counter.isPassedOnThisRound() {
+			e.accept(inst)
+		} else if now.Sub(inst.updateTime) > epaxosRecoveryTimeout {
+			log.Printf("epaxos: %d instance(%d.%d) phase(%d) timeout, recover it", e.instanceGroup.getNodeID(), id.replica, id.slot, inst.phase)
+			e.recover(id)
+		}
+	}
+
+	for id, since := range e.waiting {
+		inst := e.instances[id]
+		if (inst != nil && inst.status >= epaxosCommitted) || e.isCompacted(id) {
+			delete(e.waiting, id)
+			continue
+		}
+		if _, ok := e.leading[id]; ok || now.Sub(since) < epaxosRecoveryTimeout {
+			continue
+		}
+
+		log.Printf("epaxos: %d dependency(%d.%d) not committed, recover it", e.instanceGroup.getNodeID(), id.replica, id.slot)
+		e.waiting[id] = now
+		e.recover(id)
+	}
+}
+
+func (e *epaxos) onMessage(m message) {
+	p, err := unserializeEPaxosInstance(m.acceptValue)
+	if err != nil {
+		log.Printf("epaxos: %d bad instance type(%d) from(%d)", e.instanceGroup.getNodeID(), m.typ, m.from)
+		return
+	}
+	// 所有成员都已经执行过，只可能是重复或者延迟的消息
+	if e.isCompacted(p.id) {
+		return
+	}
+
+	switch m.typ {
+	case EPaxosPreAccept:
+		e.onPreAccept(m, p)
+	case EPaxosPreAcceptReply:
+		e.onPreAcceptReply(m, p)
+	case EPaxosAccept:
+		e.onAccept(m, p)
+	case EPaxosAcceptReply:
+		e.onAcceptReply(m, p)
+	case EPaxosCommit:
+		e.onCommit(m, p)
+	case EPaxosPrepare:
+		e.onPrepare(m, p)
+	case EPaxosPrepareReply:
+		e.onPrepareReply(m, p)
+	}
+}
+
+func (e *epaxos) propose(req *commitRequest) {
+	if req.canceled {
+		return
+	}
+
+	id := epaxosInstanceID{replica: e.instanceGroup.getNodeID(), slot: e.nextSlot}
+	e.nextSlot++
+
+	inst := &epaxosInstance{id: id, ballot: e.instanceGroup.getNodeID(), status: epaxosPreAccepted, command: req.value, request: req}
+	inst.seq, inst.deps = e.getAttributes(inst.id, inst.command, 0, nil)
+	if !e.persist(inst) {
+		e.nextSlot--
+		req.result <- ""
+		return
+	}
+	e.instances[id] = inst
+	e.recordConflict(inst)
+
+	e.startPhase(inst, epaxosPhasePreAccept, quorumPhase2)
+	e.sendToOthers(inst, message{typ: EPaxosPreAccept, proposalBallot: inst.ballot, acceptValue: serializeEPaxosInstance(inst)})
+
+	log.Printf("epaxos: %d start preAccept instance(%d.%d) seq(%d) deps(%v)", e.instanceGroup.getNodeID(), id.replica, id.slot, inst.seq, inst.deps)
+
+	if len(inst.counter.passes) == inst.counter.nodeCount {
+		e.commitInstance(inst)
+	}
+}
+
+func (e *epaxos) onPreAccept(msg message, p *epaxosInstance) {
+	inst := e.instances[p.id]
+	if inst != nil && msg.proposalBallot < inst.ballot {
+		e.reply(msg, EPaxosPreAcceptReply, inst, inst.ballot)
+		return
+	}
+	if inst != nil && inst.status >= epaxosAccepted {
+		// 已经进入后面的阶段，不能再改属性，把当前的状态告诉发起者，它不用等超时恢复
+		e.reply(msg, EPaxosPreAcceptReply, inst, 0)
+		return
+	}
+
+	if inst == nil {
+		inst = &epaxosInstance{id: p.id}
+	}
+	seq, deps := e.getAttributes(p.id, p.command, p.seq, p.deps)
+	newInst := &epaxosInstance{id: p.id, ballot: msg.proposalBallot, status: epaxosPreAccepted, seq: seq, deps: deps, command: p.command}
+	if !e.persist(newInst) {
+		return
+	}
+	e.promise(inst, msg.proposalBallot)
+	inst.status, inst.seq, inst.deps, inst.command = newInst.status, newInst.seq, newInst.deps, newInst.command
+	e.instances[inst.id] = inst
+	e.recordConflict(inst)
+
+	e.reply(msg, EPaxosPreAcceptReply, inst, 0)
+}
+
+func (e *epaxos) onPreAcceptReply(m message, p *epaxosInstance) {
+	inst := e.leading[p.id]
+	if inst == nil || inst.phase != epaxosPhasePreAccept || inst.ballot != m.proposalBallot {
+		return
+	}
+
+	if m.rejectBallot != 0 {
+		e.onReject(inst, m)
+		return
+	}
+
+	// 其他节点已经提交了这个instance，比如恢复时提交了noop，直接采用提交的结果
+	if p.status >= epaxosCommitted {
+		inst.seq, inst.deps, inst.command = p.seq, p.deps, p.command
+		e.commitInstance(inst)
+		return
+	}
+
+	if p.seq != inst.seq || !sameDeps(p.deps, inst.deps) {
+		inst.changed = true
+		if p.seq > inst.seq {
+			inst.seq = p.seq
+		}
+		mergeDeps(inst.deps, p.deps)
+	}
+	inst.counter.addPass(m.from)
+
+	if len(inst.counter.passes) == inst.counter.nodeCount && !inst.changed {
+		log.Printf("epaxos: %d fast commit instance(%d.%d) seq(%d) deps(%v)", e.instanceGroup.getNodeID(), p.id.replica, p.id.slot, inst.seq, inst.deps)
+		e.commitInstance(inst)
+	} else if inst.changed && inst.counter.isPassedOnThisRound() {
+		e.accept(inst)
+	}
+}
+
+func (e *epaxos) accept(inst *epaxosInstance) {
+	inst.status = epaxosAccepted
+	inst.acceptBallot = inst.ballot
+	if !e.persist(inst) {
+		return
+	}
+	e.recordConflict(inst)
+
+	e.startPhase(inst, epaxosPhaseAccept, quorumPhase2)
+	e.sendToOthers(inst, message{typ: EPaxosAccept, proposalBallot: inst.ballot, acceptValue: serializeEPaxosInstance(inst)})
+
+	log.Printf("epaxos: %d start accept instance(%d.%d) ballot(%d) seq(%d) deps(%v)", e.instanceGroup.getNodeID(), inst.id.replica, inst.id.slot, inst.ballot, inst.seq, inst.deps)
+
+	if inst.counter.isPassedOnThisRound() {
+		e.commitInstance(inst)
+	}
+}
+
+func (e *epaxos) onAccept(msg message, p *epaxosInstance) {
+	inst := e.instances[p.id]
+	if inst != nil && msg.proposalBallot < inst.ballot {
+		e.reply(msg, EPaxosAcceptReply, inst, inst.ballot)
+		return
+	}
+	if inst != nil && inst.status >= epaxosCommitted {
+		return
+	}
+
+	if inst == nil {
+		inst = &epaxosInstance{id: p.id}
+	}
+	newInst := &epaxosInstance{id: p.id, ballot: msg.proposalBallot, acceptBallot: msg.proposalBallot, status: epaxosAccepted, seq: p.seq, deps: p.deps, command: p.command}
+	if !e.persist(newInst) {
+		return
+	}
+	e.promise(inst, msg.proposalBallot)
+	inst.acceptBallot, inst.status, inst.seq, inst.deps, inst.command = newInst.acceptBallot, newInst.status, newInst.seq, newInst.deps, newInst.command
+	e.instances[inst.id] = inst
+	e.recordConflict(inst)
+
+	e.reply(msg, EPaxosAcceptReply, inst, 0)
+}
+
+func (e *epaxos) onAcceptReply(m message, p *epaxosInstance) {
+	inst := e.leading[p.id]
+	if inst == nil || inst.phase != epaxosPhaseAccept || inst.ballot != m.proposalBallot {
+		return
+	}
+
+	if m.rejectBallot != 0 {
+		e.onReject(inst, m)
+		return
+	}
+
+	inst.counter.addPass(m.from)
+	if inst.counter.isPassedOnThisRound() {
+		e.commitInstance(inst)
+	}
+}
+
+// commitInstance 发起者确定了命令的依赖，通知所有节点提交
+func (e *epaxos) commitInstance(inst *epaxosInstance) {
+	inst.status = epaxosCommitted
+	e.stopLeading(inst)
+	if !e.persist(inst) {
+		return
+	}
+	e.recordConflict(inst)
+	e.committed[inst.id] = inst
+
+	m := message{typ: EPaxosCommit, from: e.instanceGroup.getNodeID(), proposalBallot: inst.ballot, acceptValue: serializeEPaxosInstance(inst)}
+	e.instanceGroup.broadcast(m, false)
+
+	e.execute()
+}
+
+func (e *epaxos) onCommit(msg message, p *epaxosInstance) {
+	inst := e.instances[p.id]
+	if inst != nil && inst.status >= epaxosCommitted {
+		return
+	}
+
+	if inst == nil {
+		inst = &epaxosInstance{id: p.id, ballot: msg.proposalBallot}
+	}
+	newInst := &epaxosInstance{id: p.id, ballot: inst.ballot, acceptBallot: inst.acceptBallot, status: epaxosCommitted, seq: p.seq, deps: p.deps, command: p.command}
+	if !e.persist(newInst) {
+		return
+	}
+	inst.status, inst.seq, inst.deps, inst.command = newInst.status, newInst.seq, newInst.deps, newInst.command
+	e.stopLeading(inst)
+	e.instances[inst.id] = inst
+	e.recordConflict(inst)
+	e.committed[inst.id] = inst
+
+	e.execute()
+}
+
+// recover 用更大的ballot接管一个没有提交的instance，发起者不可用时由依赖它的节点完成提交
+func (e *epaxos) recover(id epaxosInstanceID) {
+	if e.isCompacted(id) {
+		return
+	}
+	inst := e.instances[id]
+	if inst == nil {
+		inst = &epaxosInstance{id: id}
+		e.instances[id] = inst
+	}
+	if inst.status >= epaxosCommitted {
+		e.stopLeading(inst)
+		return
+	}
+
+	ballot := e.genBallot(inst.ballot)
+	newInst := *inst
+	newInst.ballot = ballot
+	if !e.persist(&newInst) {
+		return
+	}
+	inst.ballot = ballot
+	inst.recovery = []*epaxosInstance{copyEPaxosInstance(inst)}
+
+	e.startPhase(inst, epaxosPhasePrepare, quorumPhase1)
+	e.sendToOthers(inst, message{typ: EPaxosPrepare, proposalBallot: inst.ballot, acceptValue: serializeEPaxosInstance(&epaxosInstance{id: id})})
+
+	log.Printf("epaxos: %d start prepare instance(%d.%d) ballot(%d)", e.instanceGroup.getNodeID(), id.replica, id.slot, ballot)
+
+	if inst.counter.isPassedOnThisRound() {
+		e.finishRecovery(inst)
+	}
+}
+
+func (e *epaxos) onPrepare(msg message, p *epaxosInstance) {
+	inst := e.instances[p.id]
+	if inst == nil {
+		inst = &epaxosInstance{id: p.id}
+	}
+	if msg.proposalBallot <= inst.ballot {
+		e.reply(msg, EPaxosPrepareReply, inst, inst.ballot)
+		return
+	}
+
+	newInst := *inst
+	newInst.ballot = msg.proposalBallot
+	if !e.persist(&newInst) {
+		return
+	}
+	e.promise(inst, msg.proposalBallot)
+	e.instances[inst.id] = inst
+
+	e.reply(msg, EPaxosPrepareReply, inst, 0)
+}
+
+func (e *epaxos) onPrepareReply(m message, p *epaxosInstance) {
+	inst := e.leading[p.id]
+	if inst == nil || inst.phase != epaxosPhasePrepare || inst.ballot != m.proposalBallot {
+		return
+	}
+
+	if m.rejectBallot != 0 {
+		e.onReject(inst, m)
+		return
+	}
+
+	if inst.counter.isMember(m.from) {
+		inst.recovery = append(inst.recovery, p)
+	}
+	inst.counter.addPass(m.from)
+	if inst.counter.isPassedOnThisRound() {
+		e.finishRecovery(inst)
+	}
+}
+
+// finishRecovery 根据多数派的状态决定恢复的结果。fast path需要所有成员一致，
+// 所以只要有preAccepted的回复，合并这些回复的依赖就不会跟fast path提交的结果冲突
+func (e *epaxos) finishRecovery(inst *epaxosInstance) {
+	var accepted, preAccepted *epaxosInstance
+	deps := make(map[int]int)
+	var seq int
+	for _, r := range inst.recovery {
+		switch {
+		case r.status >= epaxosCommitted:
+			inst.seq, inst.deps, inst.command = r.seq, r.deps, r.command
+			e.commitInstance(inst)
+			return
+		case r.status == epaxosAccepted:
+			if accepted == nil || r.acceptBallot > accepted.acceptBallot {
+				accepted = r
+			}
+		case r.status == epaxosPreAccepted:
+			preAccepted = r
+			if r.seq > seq {
+				seq = r.seq
+			}
+			mergeDeps(deps, r.deps)
+		}
+	}
+
+	switch {
+	case accepted != nil:
+		inst.seq, inst.deps, inst.command = accepted.seq, accepted.deps, accepted.command
+	case preAccepted != nil:
+		inst.seq, inst.deps, inst.command = seq, deps, preAccepted.command
+	default:
+		inst.seq, inst.deps, inst.command = 0, make(map[int]int), ""
+	}
+	e.accept(inst)
+}
+
+// onReject 其他节点用更大的ballot接管了这个instance
+func (e *epaxos) onReject(inst *epaxosInstance, m message) {
+	inst.counter.addReject(m.from, m.rejectBallot)
+	if inst.counter.isRejectedOnThisRound() {
+		log.Printf("epaxos: %d instance(%d.%d) rejected ballot(%d) rejectBallot(%d)", e.instanceGroup.getNodeID(), inst.id.replica, inst.id.slot, inst.ballot, inst.counter.getMaxRejectN())
+		e.genBallot(inst.counter.getMaxRejectN())
+		e.stopLeading(inst)
+	}
+}
+
+// promise 承诺了更大的ballot，本节点不再作为发起者推进这个instance
+func (e *epaxos) promise(inst *epaxosInstance, ballot int) {
+	if ballot > inst.ballot {
+		inst.ballot = ballot
+		e.stopLeading(inst)
+	}
+}
+
+func (e *epaxos) startPhase(inst *epaxosInstance, phase int, quorum int) {
+	members := e.instanceGroup.membership.getLatestNodes()
+	qc := e.instanceGroup.getQuorumConfig()
+	inst.counter.setMembers(members, qc)
+	inst.counter.startNewRound(qc.getQuorum(quorum, inst.counter.totalWeight))
+	inst.counter.addPass(e.instanceGroup.getNodeID())
+	inst.changed = false
+	inst.phase = phase
+	inst.updateTime = e.instanceGroup.now()
+	e.leading[inst.id] = inst
+}
+
+func (e *epaxos) stopLeading(inst *epaxosInstance) {
+	inst.phase = epaxosPhaseNone
+	inst.recovery = nil
+	delete(e.leading, inst.id)
+}
+
+func (e *epaxos) sendToOthers(inst *epaxosInstance, m message) {
+	m.from = e.instanceGroup.getNodeID()
+	for id := range inst.counter.members {
+		if id != e.instanceGroup.getNodeID() {
+			e.instanceGroup.send(id, m)
+		}
+	}
+}
+
+func (e *epaxos) reply(msg message, typ int, inst *epaxosInstance, rejectBallot int) {
+	m := message{typ: typ, from: e.instanceGroup.getNodeID(), proposalBallot: msg.proposalBallot, rejectBallot: rejectBallot}
+	m.acceptValue = serializeEPaxosInstance(inst)
+	e.instanceGroup.response(msg.from, m)
+}
+
+// getAttributes 在发起者给出的seq和依赖上合并本节点已知的冲突命令
+func (e *epaxos) getAttributes(id epaxosInstanceID, command string, seq int, deps map[int]int) (int, map[int]int) {
+	newDeps := make(map[int]int)
+	mergeDeps(newDeps, deps)
+	if command == "" {
+		return seq, newDeps
+	}
+
+	key := e.getKey(command)
+	for replica, slot := range e.conflicts[key] {
+		if replica == id.replica && slot >= id.slot {
+			// 同一个replica上只依赖更早的slot
+			slot = id.slot - 1
+			if slot <= 0 {
+				continue
+			}
+		}
+		if slot > newDeps[replica] {
+			newDeps[replica] = slot
+		}
+	}
+	if e.maxSeq[key]+1 > seq {
+		seq = e.maxSeq[key] + 1
+	}
+
+	return seq, newDeps
+}
+
+func (e *epaxos) recordConflict(inst *epaxosInstance) {
+	if inst.id.replica == e.instanceGroup.getNodeID() && inst.id.slot >= e.nextSlot {
+		e.nextSlot = inst.id.slot + 1
+	}
+	if inst.command == "" || inst.status == epaxosNone {
+		return
+	}
+
+	key := e.getKey(inst.command)
+	slots := e.conflicts[key]
+	if slots == nil {
+		slots = make(map[int]int)
+		e.conflicts[key] = slots
+	}
+	if inst.id.slot > slots[inst.id.replica] {
+		slots[inst.id.replica] = inst.id.slot
+	}
+	if inst.seq > e.maxSeq[key] {
+		e.maxSeq[key] = inst.seq
+	}
+}
+
+func (e *epaxos) getKey(command string) string {
+	if sm, ok := e.sm.(keyedStatemachine); ok {
+		return sm.getKey(command)
+	}
+
+	return ""
+}
+
+func (e *epaxos) genBallot(minBallot int) int {
+	sequence := minBallot >> 16
+	if sequence < e.sequence {
+		sequence = e.sequence
+	}
+	sequence++
+	e.sequence = sequence
+	return e.sequence<<16 | e.instanceGroup.getNodeID()
+}
+
+func (e *epaxos) persist(inst *epaxosInstance) bool {
+	if e.wal == nil {
+		return true
+	}
+
+	err := e.wal.append([]byte(serializeEPaxosInstance(inst)))
+	if err != nil {
+		log.Printf("epaxos: %d persist instance(%d.%d) error: %v", e.instanceGroup.getNodeID(), inst.id.replica, inst.id.slot, err)
+		return false
+	}
+
+	return true
+}
+
+// onExecuted 记录其他成员连续执行完的位置，决定哪些instance可以删除
+func (e *epaxos) onExecuted(m message) {
+	slots, err := unserializeEPaxosSlots([]byte(m.acceptValue))
+	if err != nil {
+		log.Printf("epaxos: %d bad executed slots from(%d)", e.instanceGroup.getNodeID(), m.from)
+		return
+	}
+
+	e.peerExecuted[m.from] = slots
+}
+
+func (e *epaxos) isCompacted(id epaxosInstanceID) bool {
+	return id.slot <= e.executedSlots[id.replica]
+}
+
+// executedFrontier 每个replica上连续执行完的最大slot
+func (e *epaxos) executedFrontier() map[int]int {
+	frontier := make(map[int]int)
+	for replica, slot := range e.executedSlots {
+		frontier[replica] = slot
+	}
+	for id := range e.instances {
+		if _, ok := frontier[id.replica]; !ok {
+			frontier[id.replica] = 0
+		}
+	}
+
+	for replica, slot := range frontier {
+		for {
+			inst := e.instances[epaxosInstanceID{replica: replica, slot: slot + 1}]
+			if inst == nil || inst.status != epaxosExecuted {
+				break
+			}
+			slot++
+		}
+		frontier[replica] = slot
+	}
+
+	return frontier
+}
+
+// makeSnapshot 在instance协程中定期调用。先把本节点连续执行完的位置告诉其他成员，
+// 再把所有成员都已经执行完的instance连同状态机一起做成快照，从内存跟日志中删除。
+// 有成员落后或者不可用时不会删除它还需要的instance，恢复时总能从其他节点拿到
+func (e *epaxos) makeSnapshot() {
+	nodeID := e.instanceGroup.getNodeID()
+	frontier := e.executedFrontier()
+	m := message{typ: EPaxosExecuted, from: nodeID, acceptValue: string(serializeEPaxosSlots(frontier))}
+	e.instanceGroup.broadcast(m, false)
+
+	members := e.instanceGroup.membership.getLatestNodes()
+	target := make(map[int]int)
+	changed := false
+	for replica, slot := range frontier {
+		for id := range members {
+			if id != nodeID && e.peerExecuted[id][replica] < slot {
+				slot = e.peerExecuted[id][replica]
+			}
+		}
+		if slot > e.executedSlots[replica] {
+			changed = true
+		} else {
+			slot = e.executedSlots[replica]
+		}
+		target[replica] = slot
+	}
+	if !changed {
+		return
+	}
+
+	// 快照之后的位置上已经执行的instance也反映在状态机里，重启时不能再执行
+	var executed []epaxosInstanceID
+	var remains []*epaxosInstance
+	for id, inst := range e.instances {
+		if id.slot <= target[id.replica] {
+			continue
+		}
+		if inst.status == epaxosExecuted {
+			executed = append(executed, id)
+		}
+		remains = append(remains, inst)
+	}
+	sortEPaxosInstanceIDs(executed)
+	sort.Slice(remains, func(i, j int) bool {
+		return epaxosInstanceIDLess(remains[i].id, remains[j].id)
+	})
+
+	dataDir := e.instanceGroup.getDataDir()
+	if dataDir != "" {
+		state := serializeEPaxosSnapshotState(target, executed)
+		data := serializeSnapshot(state, e.sm.snapshot(e.instanceGroup.instanceGroupID))
+		// epaxos没有全局的instanceID，快照的instanceID固定为1，只用来区分快照是否存在
+		err := saveSnapshot(filepath.Join(dataDir, "epaxos.snapshot"), 1, data)
+		if err != nil {
+			log.Printf("epaxos: %d save snapshot error: %v", nodeID, err)
+			return
+		}
+	}
+
+	count := len(e.instances) - len(remains)
+	for id := range e.instances {
+		if id.slot <= target[id.replica] {
+			delete(e.instances, id)
+		}
+	}
+	e.executedSlots = target
+
+	if e.wal != nil {
+		records := make([][]byte, 0, len(remains))
+		for _, inst := range remains {
+			records = append(records, []byte(serializeEPaxosInstance(inst)))
+		}
+		err := e.wal.rewrite(records)
+		if err != nil {
+			// 快照已经保存，旧的日志重放时会跳过快照之前的instance
+			log.Printf("epaxos: %d rewrite wal error: %v", nodeID, err)
+		}
+	}
+
+	log.Printf("epaxos: %d make snapshot executedSlots(%v) compacted(%d) remains(%d)", nodeID, target, count, len(remains))
+}
+
+// loadSnapshot 恢复快照中的状态机跟已经删除的位置，返回快照之后已经执行过的instance
+func (e *epaxos) loadSnapshot(path string) (map[epaxosInstanceID]bool, error) {
+	executed := make(map[epaxosInstanceID]bool)
+	instanceID, data, err := loadSnapshot(path)
+	if err != nil || instanceID == 0 {
+		return executed, err
+	}
+
+	state, sm, err := unserializeSnapshot(data)
+	if err != nil {
+		return nil, err
+	}
+	slots, ids, err := unserializeEPaxosSnapshotState(state)
+	if err != nil {
+		return nil, err
+	}
+	err = e.sm.restore(e.instanceGroup.instanceGroupID, sm)
+	if err != nil {
+		return nil, err
+	}
+
+	e.executedSlots = slots
+	if slot := slots[e.instanceGroup.getNodeID()]; slot >= e.nextSlot {
+		e.nextSlot = slot + 1
+	}
+	for _, id := range ids {
+		executed[id] = true
+	}
+
+	log.Printf("epaxos: %d restore snapshot executedSlots(%v) executed(%d)", e.instanceGroup.getNodeID(), slots, len(ids))
+
+	return executed, nil
+}
+
+// epaxosExecutor 一次执行过程中Tarjan算法的状态
+type epaxosExecutor struct {
+	next    int
+	index   map[epaxosInstanceID]int
+	lowlink map[epaxosInstanceID]int
+	onStack map[epaxosInstanceID]bool
+	stack   []*epaxosInstance
+}
+
+// execute 执行所有依赖都已经提交的命令
+func (e *epaxos) execute() {
+	for _, inst := range e.committed {
+		if inst.status != epaxosCommitted {
+			continue
+		}
+
+		x := &epaxosExecutor{}
+		x.index = make(map[epaxosInstanceID]int)
+		x.lowlink = make(map[epaxosInstanceID]int)
+		x.onStack = make(map[epaxosInstanceID]bool)
+		e.strongConnect(x, inst)
+	}
+}
+
+// strongConnect 依赖图的强连通分量按逆拓扑序找出，找到一个就执行一个；遇到没有提交的依赖时停止
+func (e *epaxos) strongConnect(x *epaxosExecutor, v *epaxosInstance) bool {
+	x.index[v.id] = x.next
+	x.lowlink[v.id] = x.next
+	x.next++
+	x.stack = append(x.stack, v)
+	x.onStack[v.id] = true
+
+	for replica, slot := range v.deps {
+		depID := epaxosInstanceID{replica: replica, slot: slot}
+		if e.isCompacted(depID) {
+			continue
+		}
+		dep := e.instances[depID]
+		if dep == nil || dep.status < epaxosCommitted {
+			if _, ok := e.waiting[depID]; !ok {
+				e.waiting[depID] = e.instanceGroup.now()
+			}
+			return false
+		}
+		if dep.status == epaxosExecuted {
+			continue
+		}
+
+		if _, ok := x.index[depID]; !ok {
+			if !e.strongConnect(x, dep) {
+				return false
+			}
+			if x.lowlink[depID] < x.lowlink[v.id] {
+				x.lowlink[v.id] = x.lowlink[depID]
+			}
+		} else if x.onStack[depID] && x.index[depID] < x.lowlink[v.id] {
+			x.lowlink[v.id] = x.index[depID]
+		}
+	}
+
+	if x.lowlink[v.id] != x.index[v.id] {
+		return true
+	}
+
+	var component []*epaxosInstance
+	for {
+		w := x.stack[len(x.stack)-1]
+		x.stack = x.stack[:len(x.stack)-1]
+		x.onStack[w.id] = false
+		component = append(component, w)
+		if w == v {
+			break
+		}
+	}
+
+	sort.Slice(component, func(i, j int) bool {
+		a, b := component[i], component[j]
+		if a.seq != b.seq {
+			return a.seq < b.seq
+		}
+		if a.id.replica != b.id.replica {
+			return a.id.replica < b.id.replica
+		}
+		return a.id.slot < b.id.slot
+	})
+	for _, inst := range component {
+		e.execInstance(inst)
+	}
+
+	return true
+}
+
+func (e *epaxos) execInstance(inst *epaxosInstance) {
+	var result string
+	if inst.command != "" {
+		result = e.sm.exec(inst.command)
+	}
+	inst.status = epaxosExecuted
+	delete(e.committed, inst.id)
+	delete(e.waiting, inst.id)
+
+	req := inst.request
+	if req == nil {
+		return
+	}
+	inst.request = nil
+
+	if inst.command == req.value {
+		req.result <- result
+		return
+	}
+
+	// 恢复时提交了noop，在新的slot上重新发起
+	log.Printf("epaxos: %d instance(%d.%d) committed noop, requeue request", e.instanceGroup.getNodeID(), inst.id.replica, inst.id.slot)
+	e.commitLock.Lock()
+	if !req.canceled {
+		e.commitQueue = append(e.commitQueue, req)
+	}
+	e.commitLock.Unlock()
+}
+
+func epaxosInstanceIDLess(a epaxosInstanceID, b epaxosInstanceID) bool {
+	if a.replica != b.replica {
+		return a.replica < b.replica
+	}
+	return a.slot < b.slot
+}
+
+func sortEPaxosInstanceIDs(ids []epaxosInstanceID) {
+	sort.Slice(ids, func(i, j int) bool {
+		return epaxosInstanceIDLess(ids[i], ids[j])
+	})
+}
+
+// serializeEPaxosSlots 格式为 count(4) [replica(4) slot(4)]...，按replica排序
+func serializeEPaxosSlots(slots map[int]int) []byte {
+	replicas := make([]int, 0, len(slots))
+	for replica := range slots {
+		replicas = append(replicas, replica)
+	}
+	sort.Ints(replicas)
+
+	buf := make([]byte, 4+8*len(replicas))
+	binary.LittleEndian.PutUint32(buf[0:], uint32(len(replicas)))
+	offset := 4
+	for _, replica := range replicas {
+		binary.LittleEndian.PutUint32(buf[offset:], uint32(replica))
+		binary.LittleEndian.PutUint32(buf[offset+4:], uint32(slots[replica]))
+		offset += 8
+	}
+
+	return buf
+}
+
+func unserializeEPaxosSlots(buf []byte) (map[int]int, error) {
+	if len(buf) < 4 {
+		return nil, errBadEPaxosInstance
+	}
+	count := binary.LittleEndian.Uint32(buf[0:])
+	if uint64(count) != uint64(len(buf)-4)/8 || (len(buf)-4)%8 != 0 {
+		return nil, errBadEPaxosInstance
+	}
+
+	slots := make(map[int]int, count)
+	for offset := 4; offset < len(buf); offset += 8 {
+		slots[int(binary.LittleEndian.Uint32(buf[offset:]))] = int(binary.LittleEndian.Uint32(buf[offset+4:]))
+	}
+
+	return slots, nil
+}
+
+// serializeEPaxosSnapshotState 格式为 slotsSize(4) slots count(4) [replica(4) slot(4)]...，slots是serializeEPaxosSlots的格式
+func serializeEPaxosSnapshotState(slots map[int]int, executed []epaxosInstanceID) string {
+	slotsBuf := serializeEPaxosSlots(slots)
+
+	buf := make([]byte, 4, 4+len(slotsBuf)+4+8*len(executed))
+	binary.LittleEndian.PutUint32(buf[0:], uint32(len(slotsBuf)))
+	buf = append(buf, slotsBuf...)
+
+	var field [4]byte
+	binary.LittleEndian.PutUint32(field[:], uint32(len(executed)))
+	buf = append(buf, field[:]...)
+	for _, id := range executed {
+		binary.LittleEndian.PutUint32(field[:], uint32(id.replica))
+		buf = append(buf, field[:]...)
+		binary.LittleEndian.PutUint32(field[:], uint32(id.slot))
+		buf = append(buf, field[:]...)
+	}
+
+	return string(buf)
+}
+
+func unserializeEPaxosSnapshotState(data string) (map[int]int, []epaxosInstanceID, error) {
+	buf := []byte(data)
+	if len(buf) < 4 || uint64(len(buf)-4) < uint64(binary.LittleEndian.Uint32(buf[0:])) {
+		return nil, nil, errBadSnapshot
+	}
+	size := int(binary.LittleEndian.Uint32(buf[0:]))
+	slots, err := unserializeEPaxosSlots(buf[4 : 4+size])
+	if err != nil {
+		return nil, nil, errBadSnapshot
+	}
+
+	buf = buf[4+size:]
+	if len(buf) < 4 || uint64(len(buf)-4) != 8*uint64(binary.LittleEndian.Uint32(buf[0:])) {
+		return nil, nil, errBadSnapshot
+	}
+	var executed []epaxosInstanceID
+	for offset := 4; offset < len(buf); offset += 8 {
+		executed = append(executed, epaxosInstanceID{replica: int(binary.LittleEndian.Uint32(buf[offset:])), slot: int(binary.LittleEndian.Uint32(buf[offset+4:]))})
+	}
+
+	return slots, executed, nil
+}
+
+func copyEPaxosInstance(inst *epaxosInstance) *epaxosInstance {
+	newInst := &epaxosInstance{id: inst.id, ballot: inst.ballot, acceptBallot: inst.acceptBallot, status: inst.status, seq: inst.seq, command: inst.command}
+	newInst.deps = make(map[int]int)
+	mergeDeps(newInst.deps, inst.deps)
+
+	return newInst
+}
+
+func sameDeps(a map[int]int, b map[int]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// mergeDeps 把src合并到dst，每个replica取较大的slot
+func mergeDeps(dst map[int]int, src map[int]int) {
+	for replica, slot := range src {
+		if slot > dst[replica] {
+			dst[replica] = slot
+		}
+	}
+}
+
+// serializeEPaxosInstance 格式为 replica(4) slot(4) ballot(4) acceptBallot(4) status(4) seq(4) depCount(4) [replica(4) slot(4)]... command
+func serializeEPaxosInstance(inst *epaxosInstance) string {
+	replicas := make([]int, 0, len(inst.deps))
+	for replica := range inst.deps {
+		replicas = append(replicas, replica)
+	}
+	sort.Ints(replicas)
+
+	buf := make([]byte, 28+8*len(replicas)+len(inst.command))
+	binary.LittleEndian.PutUint32(buf[0:], uint32(inst.id.replica))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(inst.id.slot))
+	binary.LittleEndian.PutUint32(buf[8:], uint32(inst.ballot))
+	binary.LittleEndian.PutUint32(buf[12:], uint32(inst.acceptBallot))
+	binary.LittleEndian.PutUint32(buf[16:], uint32(inst.status))
+	binary.LittleEndian.PutUint32(buf[20:], uint32(inst.seq))
+	binary.LittleEndian.PutUint32(buf[24:], uint32(len(replicas)))
+	offset := 28
+	for _, replica := range replicas {
+		binary.LittleEndian.PutUint32(buf[offset:], uint32(replica))
+		binary.LittleEndian.PutUint32(buf[offset+4:], uint32(inst.deps[replica]))
+		offset += 8
+	}
+	copy(buf[offset:], inst.command)
+
+	return string(buf)
+}
+
+func unserializeEPaxosInstance(data string) (*epaxosInstance, error) {
+	buf := []byte(data)
+	if len(buf) < 28 {
+		return nil, errBadEPaxosInstance
+	}
+
+	inst := &epaxosInstance{}
+	inst.id.replica = int(binary.LittleEndian.Uint32(buf[0:]))
+	inst.id.slot = int(binary.LittleEndian.Uint32(buf[4:]))
+	inst.ballot = int(binary.LittleEndian.Uint32(buf[8:]))
+	inst.acceptBallot = int(binary.LittleEndian.Uint32(buf[12:]))
+	inst.status = int(binary.LittleEndian.Uint32(buf[16:]))
+	inst.seq = int(binary.LittleEndian.Uint32(buf[20:]))
+	count := binary.LittleEndian.Uint32(buf[24:])
+	if uint64(count) > uint64(len(buf)-28)/8 {
+		return nil, errBadEPaxosInstance
+	}
+	offset := 28
+	inst.deps = make(map[int]int, count)
+	for i := uint32(0); i < count; i++ {
+		inst.deps[int(binary.LittleEndian.Uint32(buf[offset:]))] = int(binary.LittleEndian.Uint32(buf[offset+4:]))
+		offset += 8
+	}
+	inst.command = string(buf[offset:])
+
+	return inst, nil
+}
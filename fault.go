@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	errFaultDisabled = errors.New("fault injection is not enabled")
+	errBadFaultArg   = errors.New("bad fault argument")
+	errUnknownFault  = errors.New("unknown fault argument")
+)
+
+// FaultConfig 运行时注入的网络故障，只影响跟其他节点之间的消息，零值表示不注入
+type FaultConfig struct {
+	Blocked  map[int]bool  // 跟这些节点之间收发的消息都丢弃，用来制造网络分区
+	Delay    time.Duration // 每个发出的消息固定的额外延迟
+	Jitter   time.Duration // 每个发出的消息在 [0, Jitter) 之间随机的额外延迟，消息因此乱序
+	DropRate float64       // 发出的消息被丢弃的概率
+	DupRate  float64       // 发出的消息被重复发送的概率
+}
+
+func (cfg FaultConfig) String() string {
+	blocked := make([]int, 0, len(cfg.Blocked))
+	for id := range cfg.Blocked {
+		blocked = append(blocked, id)
+	}
+	sort.Ints(blocked)
+
+	return fmt.Sprintf("blocked: %v delay: %v jitter: %v drop: %g dup: %g", blocked, cfg.Delay, cfg.Jitter, cfg.DropRate, cfg.DupRate)
+}
+
+// faultTransport 包装节点的Transport，按当前的FaultConfig丢弃、延迟或者重复消息。
+// 延迟的消息在定时器协程里发送，发给自己的消息不受影响
+type faultTransport struct {
+	Transport
+	nodeID int
+	cfg    FaultConfig
+	rand   *rand.Rand
+	lock   sync.Mutex // 管理接口、instance协程跟定时器协程保护锁
+}
+
+func newFaultTransport(nodeID int, transport Transport) *faultTransport {
+	return &faultTransport{Transport: transport, nodeID: nodeID, rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (t *faultTransport) setConfig(cfg FaultConfig) {
+	blocked := make(map[int]bool, len(cfg.Blocked))
+	for id, v := range cfg.Blocked {
+		blocked[id] = v
+	}
+	cfg.Blocked = blocked
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.cfg = cfg
+	log.Printf("fault: %d set %s", t.nodeID, cfg)
+}
+
+func (t *faultTransport) getConfig() FaultConfig {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.cfg
+}
+
+func (t *faultTransport) send(id int, m message) {
+	t.inject(id, m, t.Transport.send)
+}
+
+func (t *faultTransport) response(id int, m message) {
+	t.inject(id, m, t.Transport.response)
+}
+
+// recv 丢弃从被隔离的节点收到的消息
+func (t *faultTransport) recv(timeout time.Duration) (message, bool) {
+	m, ok := t.Transport.recv(timeout)
+	if !ok || m.from == t.nodeID {
+		return m, ok
+	}
+
+	t.lock.Lock()
+	blocked := t.cfg.Blocked[m.from]
+	t.lock.Unlock()
+	if blocked {
+		return message{}, false
+	}
+
+	return m, true
+}
+
+func (t *faultTransport) inject(id int, m message, send func(int, message)) {
+	if id == t.nodeID {
+		send(id, m)
+		return
+	}
+
+	t.lock.Lock()
+	if t.cfg.Blocked[id] || t.rand.Float64() < t.cfg.DropRate {
+		t.lock.Unlock()
+		return
+	}
+	copies := 1
+	if t.rand.Float64() < t.cfg.DupRate {
+		copies = 2
+	}
+	delays := make([]time.Duration, copies)
+	for i := range delays {
+		delays[i] = t.cfg.Delay
+		if t.cfg.Jitter > 0 {
+			delays[i] += time.Duration(t.rand.Int63n(int64(t.cfg.Jitter)))
+		}
+	}
+	t.lock.Unlock()
+
+	for _, delay := range delays {
+		if delay <= 0 {
+			send(id, m)
+			continue
+		}
+		time.AfterFunc(delay, func() {
+			send(id, m)
+		})
+	}
+}
+
+// baseTransport 去掉故障注入的包装，返回实际收发消息的Transport
+func baseTransport(transport Transport) Transport {
+	if t, ok := transport.(*faultTransport); ok {
+		return t.Transport
+	}
+	return transport
+}
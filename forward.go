@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// forwardCommitTimeout master替转发方提交的最长时间，转发方自己的ctx不会跨网络传过来。
+// 转发方最多再多等forwardResponseSlack，请求或者回复丢失时不会一直等下去
+const (
+	forwardCommitTimeout = time.Second * 10
+	forwardResponseSlack = time.Second * 2
+)
+
+type forwardResult struct {
+	value string
+	err   error
+}
+
+// forwarder 非master节点把提交转发给持有租期的master，由master的proposer统一发起，
+// 结果再通过ForwardResponse返回，客户端可以访问任意节点而不会造成多个proposer互相抢占
+type forwarder struct {
+	instanceGroup *InstanceGroup
+	lock          sync.Mutex // commit协程跟instance协程保护锁
+	seq           int
+	pendings      map[int]chan forwardResult
+}
+
+func newForwarder(instanceGroup *InstanceGroup) *forwarder {
+	f := &forwarder{instanceGroup: instanceGroup}
+	f.pendings = make(map[int]chan forwardResult)
+
+	return f
+}
+
+// forward 把值转发给master并等待提交结果
+func (f *forwarder) forward(ctx context.Context, master int, val string) (string, error) {
+	f.lock.Lock()
+	f.seq++
+	seq := f.seq
+	done := make(chan forwardResult, 1)
+	f.pendings[seq] = done
+	f.lock.Unlock()
+
+	defer func() {
+		f.lock.Lock()
+		delete(f.pendings, seq)
+		f.lock.Unlock()
+	}()
+
+	m := message{typ: ForwardRequest, from: f.instanceGroup.getNodeID(), seq: seq, acceptValue: val}
+	f.instanceGroup.send(master, m)
+
+	timer := time.NewTimer(forwardCommitTimeout + forwardResponseSlack)
+	defer timer.Stop()
+
+	select {
+	case result := <-done:
+		return result.value, result.err
+	case <-ctx.Done():
+		return "", contextError(ctx)
+	case <-timer.C:
+		// 不知道master有没有提交，跟本地提交超时一样处理
+		return "", errCommitTimeout
+	}
+}
+
+// onForwardRequest 在单独的协程里提交，避免阻塞instance协程
+func (f *forwarder) onForwardRequest(msg message) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), forwardCommitTimeout)
+		defer cancel()
+
+		m := message{typ: ForwardResponse, from: f.instanceGroup.getNodeID(), seq: msg.seq}
+		result, err := f.instanceGroup.commitLocal(ctx, msg.acceptValue)
+		if err != nil {
+			// rejectBallot非0表示提交失败，acceptValue带回错误信息
+			m.rejectBallot = 1
+			m.acceptValue = err.Error()
+		} else {
+			m.acceptValue = result
+		}
+		f.instanceGroup.response(msg.from, m)
+	}()
+}
+
+func (f *forwarder) onForwardResponse(m message) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	done := f.pendings[m.seq]
+	if done == nil {
+		return
+	}
+
+	if m.rejectBallot != 0 {
+		done <- forwardResult{err: forwardError(m.acceptValue)}
+	} else {
+		done <- forwardResult{value: m.acceptValue}
+	}
+	delete(f.pendings, m.seq)
+}
+
+// forwardError 把master返回的错误信息还原成本地的错误，调用方可以继续按错误类型区分
+func forwardError(s string) error {
+	for _, err := range []error{errNotMaster, errCommitTimeout, errCommitCanceled, errValueTooLarge, errCommitUnknown} {
+		if err.Error() == s {
+			return err
+		}
+	}
+	return errors.New(s)
+}
@@ -1,42 +1,155 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
+	"sync/atomic"
 	"time"
 )
 
+var (
+	errObserver = errors.New("observer can not commit")
+	errWitness  = errors.New("witness can not serve requests")
+)
+
 type InstanceGroup struct {
-	instanceGroupID int
-	node            *Node
-	tm              *timerMgr
-	nextInstanceID  int
-	learner         *learner
-	acceptor        *acceptor
-	proposer        *proposer
+	instanceGroupID   int
+	node              *Node
+	recvQueue         chan message
+	tm                *timerMgr
+	nextInstanceID    int
+	appliedInstanceID int64 // 已经执行到状态机的最大instanceID，读协程也会访问
+	learner           *learner
+	acceptor          *acceptor
+	proposer          *proposer
+	master            *masterMgr
+	readIndex         *readIndex
+	forwarder         *forwarder
+	epaxos            *epaxos // 为nil时普通的值也走proposer
+	membership        *membership
 }
 
 func newInstanceGroup(node *Node, instanceGroupID int, sm statemachine) *InstanceGroup {
 	instanceGroup := &InstanceGroup{node: node, instanceGroupID: instanceGroupID, nextInstanceID: 1}
-	instanceGroup.tm = newTimerMgr()
+	instanceGroup.recvQueue = make(chan message, 1024)
+	instanceGroup.tm = newTimerMgr(node.clock)
+	instanceGroup.membership = newMembership(instanceGroup, node.getBootstrapNodes())
 	instanceGroup.acceptor = newAcceptor(instanceGroup)
+	if instanceGroup.acceptor == nil {
+		return nil
+	}
 	instanceGroup.proposer = newProposer(instanceGroup)
+	instanceGroup.master = newMasterMgr(instanceGroup)
+	instanceGroup.readIndex = newReadIndex(instanceGroup)
+	instanceGroup.forwarder = newForwarder(instanceGroup)
 	instanceGroup.learner = newLearner(instanceGroup, sm)
+	if instanceGroup.learner == nil {
+		return nil
+	}
+	instanceGroup.acceptor.compact(instanceGroup.learner.snapshotInstanceID)
+	if node.isEPaxos() {
+		instanceGroup.epaxos = newEPaxos(instanceGroup, sm)
+		if instanceGroup.epaxos == nil {
+			return nil
+		}
+	}
+	instanceGroup.tm.addTimer(SnapshotTimeout, snapshotInterval, instanceGroup.checkSnapshot)
+
+	if node.isStepped() {
+		return instanceGroup
+	}
 
 	go instanceGroup.run()
+	if !node.isObserver() && !node.isWitness() {
+		go instanceGroup.master.run()
+	}
 
 	return instanceGroup
 }
 
-func (instanceGroup *InstanceGroup) commit(val string) (string, error) {
-	return instanceGroup.proposer.commit(val)
+// commit 租期内只有master可以提交，其他节点把值转发给master，避免多个proposer互相抢占
+func (instanceGroup *InstanceGroup) commit(ctx context.Context, val string) (string, error) {
+	if instanceGroup.node.isObserver() {
+		return "", errObserver
+	}
+	if instanceGroup.node.isWitness() {
+		return "", errWitness
+	}
+
+	// epaxos模式下普通的值由本节点直接发起，系统值仍然需要跟learner一起全局有序
+	if instanceGroup.epaxos != nil && !isSystemValue(val) {
+		return instanceGroup.epaxos.commit(ctx, val)
+	}
+
+	// fast paxos直接由本节点发起fast round，不需要先转发给master
+	master := instanceGroup.master.getMaster()
+	if master != 0 && master != instanceGroup.getNodeID() && !instanceGroup.isFastPaxos() {
+		// 过大的值在转发之前就拒绝，否则转发请求本身放不进网络帧
+		if err := instanceGroup.proposer.checkValueSize(val); err != nil {
+			return "", err
+		}
+		return instanceGroup.forwarder.forward(ctx, master, val)
+	}
+
+	ret, err := instanceGroup.proposer.commit(ctx, val)
+	if err == errNotMaster {
+		// 排队期间其他节点成为了master，请求还没有发起，转发给新的master
+		master := instanceGroup.master.getMaster()
+		if master != 0 && master != instanceGroup.getNodeID() {
+			return instanceGroup.forwarder.forward(ctx, master, val)
+		}
+	}
+
+	return ret, err
+}
+
+// commitLocal 处理其他节点转发过来的值，只在本节点提交，不再继续转发
+func (instanceGroup *InstanceGroup) commitLocal(ctx context.Context, val string) (string, error) {
+	if instanceGroup.node.isObserver() || instanceGroup.node.isWitness() {
+		return "", errNotMaster
+	}
+
+	master := instanceGroup.master.getMaster()
+	if master != 0 && master != instanceGroup.getNodeID() {
+		return "", errNotMaster
+	}
+
+	return instanceGroup.proposer.commit(ctx, val)
 }
 
 func (instanceGroup *InstanceGroup) getNodeID() int {
 	return instanceGroup.node.getNodeID()
 }
 
-func (instanceGroup *InstanceGroup) getNodeCount() int {
-	return instanceGroup.node.getNodeCount()
+func (instanceGroup *InstanceGroup) isFastPaxos() bool {
+	return instanceGroup.node.isFastPaxos()
+}
+
+func (instanceGroup *InstanceGroup) getQuorumConfig() *quorumConfig {
+	return instanceGroup.node.getQuorumConfig()
+}
+
+// getMembers 返回instanceID对应的成员列表
+func (instanceGroup *InstanceGroup) getMembers(instanceID int) map[int]string {
+	return instanceGroup.membership.getNodes(instanceID)
+}
+
+func (instanceGroup *InstanceGroup) getPipelineWindow() int {
+	return instanceGroup.node.getPipelineWindow()
+}
+
+func (instanceGroup *InstanceGroup) now() time.Time {
+	return instanceGroup.node.now()
+}
+
+// getMaxValueSize 一个消息能携带的值的最大长度
+func (instanceGroup *InstanceGroup) getMaxValueSize() int {
+	return instanceGroup.node.getMaxValueSize()
+}
+
+func (instanceGroup *InstanceGroup) getDataDir() string {
+	return instanceGroup.node.getDataDir(instanceGroup.instanceGroupID)
 }
 
 func (instanceGroup *InstanceGroup) getNextInstanceID() int {
@@ -47,55 +160,243 @@ func (instanceGroup *InstanceGroup) updateNextInstanceID() {
 	instanceGroup.nextInstanceID++
 }
 
+func (instanceGroup *InstanceGroup) setNextInstanceID(instanceID int) {
+	instanceGroup.nextInstanceID = instanceID
+}
+
+func (instanceGroup *InstanceGroup) getAppliedInstanceID() int {
+	return int(atomic.LoadInt64(&instanceGroup.appliedInstanceID))
+}
+
+func (instanceGroup *InstanceGroup) setAppliedInstanceID(instanceID int) {
+	atomic.StoreInt64(&instanceGroup.appliedInstanceID, int64(instanceID))
+}
+
+// canReadLocal 持有master租期时其他节点选定不了新的值，执行到当选时多数派接受过的最大instance之后，
+// 本地状态机已经包含所有完成了的写，可以直接读。两个phase2多数派不一定相交、当选后成员有变化、
+// fast paxos下其他节点也会直接提交时，租期都不能保证这一点
+func (instanceGroup *InstanceGroup) canReadLocal() bool {
+	if instanceGroup.isFastPaxos() {
+		return false
+	}
+
+	readIndex, masterVersion, ok := instanceGroup.master.getReadIndex()
+	if !ok {
+		return false
+	}
+
+	nodes, ok := instanceGroup.membership.getStableNodes(masterVersion)
+	if !ok {
+		return false
+	}
+	qc := instanceGroup.getQuorumConfig()
+	total := qc.getTotalWeight(nodes)
+	if 2*qc.getQuorum(quorumPhase2, total) <= total {
+		return false
+	}
+
+	return instanceGroup.getAppliedInstanceID() >= readIndex
+}
+
+// checkSnapshot 定期对状态机做快照，并截断三个角色在快照之前的状态。
+// epaxos模式下状态机只由epaxos修改，由epaxos自己做快照，learner的日志里只有系统值，不做快照
+func (instanceGroup *InstanceGroup) checkSnapshot(int) {
+	if instanceGroup.epaxos == nil {
+		instanceID, ok := instanceGroup.learner.makeSnapshot()
+		if ok {
+			instanceGroup.compact(instanceID)
+		}
+	} else {
+		instanceGroup.epaxos.makeSnapshot()
+	}
+
+	instanceGroup.tm.addTimer(SnapshotTimeout, snapshotInterval, instanceGroup.checkSnapshot)
+}
+
+// execSystemValue 执行学习到的系统值
+func (instanceGroup *InstanceGroup) execSystemValue(instanceID int, value string) string {
+	typ, data := unserializeSystemValue(value)
+	switch typ {
+	case systemMaster:
+		return instanceGroup.master.onLearn(instanceID, data)
+	case systemMembership:
+		return instanceGroup.membership.onLearn(instanceID, data)
+	default:
+		log.Printf("node: %d unexpected system value type: %d instanceID(%d)\n", instanceGroup.getNodeID(), typ, instanceID)
+	}
+
+	return ""
+}
+
+// snapshotSystem 导出需要跟状态机一起进入快照的系统状态
+func (instanceGroup *InstanceGroup) snapshotSystem() string {
+	states := make(map[int]string)
+	states[systemMaster] = instanceGroup.master.snapshot()
+	states[systemMembership] = instanceGroup.membership.snapshot()
+
+	return serializeSystemState(states)
+}
+
+// systemSnapshot 从快照中解析出的系统状态，全部解析成功之后才替换，不会只恢复一部分
+type systemSnapshot struct {
+	hasMaster bool
+	master    masterInfo
+	configs   []membershipConfig
+}
+
+func unserializeSystemSnapshot(data string) (systemSnapshot, error) {
+	var snap systemSnapshot
+	states, err := unserializeSystemState(data)
+	if err != nil {
+		return snap, err
+	}
+
+	if state, ok := states[systemMaster]; ok {
+		snap.master, err = unserializeMasterInfo(state)
+		if err != nil {
+			return snap, err
+		}
+		snap.hasMaster = true
+	}
+	if state, ok := states[systemMembership]; ok {
+		snap.configs, err = unserializeMembershipConfigs(state)
+		if err != nil {
+			return snap, err
+		}
+	}
+
+	return snap, nil
+}
+
+func (instanceGroup *InstanceGroup) restoreSystem(snap systemSnapshot) {
+	if snap.hasMaster {
+		instanceGroup.master.restore(snap.master)
+	}
+	if snap.configs != nil {
+		instanceGroup.membership.restore(snap.configs)
+	}
+}
+
+// compact 截断acceptor跟proposer在instanceID及之前的状态
+func (instanceGroup *InstanceGroup) compact(instanceID int) {
+	instanceGroup.acceptor.compact(instanceID)
+	instanceGroup.proposer.compact(instanceID)
+}
+
 func (instanceGroup *InstanceGroup) send(id int, m message) {
+	m.instanceGroupID = instanceGroup.instanceGroupID
 	instanceGroup.node.network.send(id, m)
 }
 
 func (instanceGroup *InstanceGroup) response(id int, m message) {
+	m.instanceGroupID = instanceGroup.instanceGroupID
 	instanceGroup.node.network.response(id, m)
 }
 
+func (instanceGroup *InstanceGroup) recv(timeout time.Duration) (message, bool) {
+	select {
+	case m := <-instanceGroup.recvQueue:
+		return m, true
+	case <-time.After(timeout):
+		return message{}, false
+	}
+}
+
 func (instanceGroup *InstanceGroup) broadcast(m message, self bool) {
-	for k := range instanceGroup.node.network.nodeConns1 {
+	for _, k := range instanceGroup.node.network.getNodeIDs() {
 		if !self && k == instanceGroup.node.getNodeID() {
 			continue
 		}
 
-		instanceGroup.node.network.send(k, m)
+		instanceGroup.send(k, m)
+	}
+}
+
+// broadcastTo 发给成员列表中的所有节点，包括自己
+func (instanceGroup *InstanceGroup) broadcastTo(nodes map[int]string, m message) {
+	for k := range nodes {
+		instanceGroup.send(k, m)
 	}
 }
 
 func (instanceGroup *InstanceGroup) run() {
 	for {
-		m, ok := instanceGroup.node.network.recv(time.Millisecond * 10)
-
+		m, ok := instanceGroup.recv(time.Millisecond * 10)
 		if ok {
-			switch m.typ {
-			case Prepare:
-				instanceGroup.acceptor.onPrepare(m)
-			case Propose:
-				instanceGroup.acceptor.onAccept(m)
-			case Promised:
-				instanceGroup.proposer.onPromised(m)
-			case Accepted:
-				instanceGroup.proposer.onAccepted(m)
-			case PushLearn:
-				instanceGroup.learner.leanValue(m)
-			case PullLearnRequest:
-				instanceGroup.learner.onPullLearnRequest(m)
-			case PullLearnResponse:
-				instanceGroup.learner.onPullLearnResponse(m)
-
-			default:
-				log.Printf("node: %d unexpected message type: %d\n", instanceGroup.node.getNodeID(), m.typ)
-			}
+			instanceGroup.handleMessage(m)
 		}
 
-		instanceGroup.tm.update()
-		instanceGroup.proposer.update(true)
+		instanceGroup.tick()
 
 		select {
 		case <-time.After(time.Microsecond):
 		}
 	}
 }
+
+// handleMessage 把消息交给对应的角色处理，只在instance协程或者模拟器中调用
+func (instanceGroup *InstanceGroup) handleMessage(m message) {
+	switch m.typ {
+	case Prepare, Propose:
+		if instanceGroup.node.isObserver() {
+			log.Printf("node: %d observer ignore message type(%d) from(%d)", instanceGroup.getNodeID(), m.typ, m.from)
+		} else if m.typ == Prepare {
+			instanceGroup.acceptor.onPrepare(m)
+		} else {
+			instanceGroup.acceptor.onAccept(m)
+		}
+	case Promised:
+		instanceGroup.proposer.onPromised(m)
+	case Accepted:
+		instanceGroup.proposer.onAccepted(m)
+	case PushLearn:
+		instanceGroup.learner.leanValue(m)
+	case PullLearnRequest:
+		instanceGroup.learner.onPullLearnRequest(m)
+	case PullLearnResponse:
+		instanceGroup.learner.onPullLearnResponse(m)
+	case SnapshotChunk:
+		instanceGroup.learner.onSnapshotChunk(m)
+	case ReadIndexRequest:
+		instanceGroup.readIndex.onReadIndexRequest(m)
+	case ReadIndexResponse:
+		instanceGroup.readIndex.onReadIndexResponse(m)
+	case ForwardRequest:
+		instanceGroup.forwarder.onForwardRequest(m)
+	case ForwardResponse:
+		instanceGroup.forwarder.onForwardResponse(m)
+	case EPaxosPreAccept, EPaxosPreAcceptReply, EPaxosAccept, EPaxosAcceptReply, EPaxosCommit, EPaxosPrepare, EPaxosPrepareReply:
+		if instanceGroup.epaxos != nil {
+			instanceGroup.epaxos.onMessage(m)
+		}
+	case EPaxosExecuted:
+		if instanceGroup.epaxos != nil {
+			instanceGroup.epaxos.onExecuted(m)
+		}
+
+	default:
+		log.Printf("node: %d unexpected message type: %d\n", instanceGroup.node.getNodeID(), m.typ)
+	}
+}
+
+// tick 处理到期的定时器，发起排队的提交
+func (instanceGroup *InstanceGroup) tick() {
+	instanceGroup.tm.update()
+	instanceGroup.proposer.update()
+	if instanceGroup.epaxos != nil {
+		instanceGroup.epaxos.update()
+	}
+}
+
+// close 关闭各个角色的预写日志，模拟节点崩溃，之后可以用同一个数据目录重新创建
+func (instanceGroup *InstanceGroup) close() {
+	if instanceGroup.acceptor.wal != nil {
+		instanceGroup.acceptor.wal.close()
+	}
+	if instanceGroup.learner.wal != nil {
+		instanceGroup.learner.wal.close()
+	}
+	if instanceGroup.epaxos != nil && instanceGroup.epaxos.wal != nil {
+		instanceGroup.epaxos.wal.close()
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"sync"
 )
@@ -11,6 +14,8 @@ const (
 	Get
 )
 
+var errBadResult = errors.New("bad result")
+
 type kvOpInfo struct {
 	opType  int
 	key     string
@@ -31,54 +36,58 @@ type KVService struct {
 }
 
 // NewKVService 创建KVService
-func NewKVService(nodeID int, listenAddr string, nodeAddrs map[int]string, groupCount int) *KVService {
+func NewKVService(cfg NodeConfig, groupCount int) *KVService {
 	kvService := &KVService{}
-	kvService.node = newNode(nodeID, listenAddr, nodeAddrs)
+	kvService.node = newNode(cfg)
+	if kvService.node == nil {
+		return nil
+	}
 	kvService.storage = make(map[string]*kvValue)
 	kvService.instanceGroups = make([]*InstanceGroup, groupCount)
 	for i := 0; i < groupCount; i++ {
 		kvService.instanceGroups[i] = kvService.node.newInstanceGroup(i, kvService)
+		if kvService.instanceGroups[i] == nil {
+			return nil
+		}
 	}
 	return kvService
 }
 
 // Set 设置一个值
-func (kv *KVService) Set(key string, value string, version int32) (string, int32) {
-	hashKey := djbhash(key) % uint64(len(kv.instanceGroups))
-	instanceGroup := kv.instanceGroups[hashKey]
+func (kv *KVService) Set(ctx context.Context, key string, value string, version int32) (string, int32, error) {
+	instanceGroup := kv.instanceGroups[kv.getInstanceGroupID(key)]
 
 	valueBuf := serializeOpInfo(kvOpInfo{opType: Set, key: key, value: value, version: version})
-	resultBuf, err := instanceGroup.commit(valueBuf)
+	resultBuf, err := instanceGroup.commit(ctx, valueBuf)
 	if err != nil {
-		return "", 0
+		return "", 0, err
 	}
 
 	kvOpInfo := unserializeOpInfo(resultBuf)
 	if kvOpInfo == nil {
-		return "", 0
+		return "", 0, errBadResult
 	}
 
-	return kvOpInfo.value, kvOpInfo.version
+	return kvOpInfo.value, kvOpInfo.version, nil
 }
 
 // Del 删除一个值
-func (kv *KVService) Del(key string, version int32) (string, int32) {
-	hashKey := djbhash(key) % uint64(len(kv.instanceGroups))
-	instanceGroup := kv.instanceGroups[hashKey]
+func (kv *KVService) Del(ctx context.Context, key string, version int32) (string, int32, error) {
+	instanceGroup := kv.instanceGroups[kv.getInstanceGroupID(key)]
 
 	valueBuf := serializeOpInfo(kvOpInfo{opType: Del, key: key, value: "*", version: version})
-	resultBuf, err := instanceGroup.commit(valueBuf)
+	resultBuf, err := instanceGroup.commit(ctx, valueBuf)
 
 	if err != nil {
-		return "", 0
+		return "", 0, err
 	}
 
 	kvOpInfo := unserializeOpInfo(resultBuf)
 	if kvOpInfo == nil {
-		return "", 0
+		return "", 0, errBadResult
 	}
 
-	return kvOpInfo.value, kvOpInfo.version
+	return kvOpInfo.value, kvOpInfo.version, nil
 }
 
 // GetLocal 从本节点获取值，不保证一致性
@@ -95,22 +104,121 @@ func (kv *KVService) GetLocal(key string) (string, int32) {
 }
 
 // GetGlobal 从全局获取值，保证一致性
-func (kv *KVService) GetGlobal(key string) (string, int32) {
-	hashKey := djbhash(key) % uint64(len(kv.instanceGroups))
-	instanceGroup := kv.instanceGroups[hashKey]
+func (kv *KVService) GetGlobal(ctx context.Context, key string) (string, int32, error) {
+	if kv.node.isWitness() {
+		return "", 0, errWitness
+	}
+
+	instanceGroup := kv.instanceGroups[kv.getInstanceGroupID(key)]
+	if instanceGroup.epaxos != nil {
+		// epaxos没有全局的instanceID，读也作为命令提交，跟同一个key的写排序
+		return kv.get(ctx, instanceGroup, key)
+	}
+	if !instanceGroup.canReadLocal() {
+		// 不能直接读时向多数派确认已选定的位置，等本地执行到那里再读，不需要往日志里写Get
+		err := instanceGroup.readIndex.wait(ctx)
+		if err != nil {
+			return "", 0, err
+		}
+	}
+
+	value, version := kv.GetLocal(key)
+	return value, version, nil
+}
 
-	valueBuf := serializeOpInfo(kvOpInfo{opType: Get, key: key, value: "*", version: 0})
-	resultValueBuf, err := instanceGroup.commit(valueBuf)
+func (kv *KVService) get(ctx context.Context, instanceGroup *InstanceGroup, key string) (string, int32, error) {
+	resultBuf, err := instanceGroup.commit(ctx, serializeOpInfo(kvOpInfo{opType: Get, key: key, value: "*"}))
 	if err != nil {
-		return "", 0
+		return "", 0, err
 	}
 
-	kvOpValue := unserializeOpInfo(resultValueBuf)
-	if kvOpValue == nil {
-		return "", 0
+	kvOpInfo := unserializeOpInfo(resultBuf)
+	if kvOpInfo == nil {
+		return "", 0, errBadResult
+	}
+
+	return kvOpInfo.value, kvOpInfo.version, nil
+}
+
+// CorruptFrames 返回节点之间校验失败被丢弃的帧数，只有TCP传输会校验帧
+func (kv *KVService) CorruptFrames() uint64 {
+	network, ok := baseTransport(kv.node.network).(*NodeNetwork)
+	if !ok {
+		return 0
+	}
+	return network.getCorruptFrames()
+}
+
+// SetFaults 替换本节点当前注入的网络故障
+func (kv *KVService) SetFaults(faults FaultConfig) error {
+	if kv.node.faults == nil {
+		return errFaultDisabled
+	}
+
+	kv.node.faults.setConfig(faults)
+	return nil
+}
+
+// Faults 返回本节点当前注入的网络故障
+func (kv *KVService) Faults() (FaultConfig, error) {
+	if kv.node.faults == nil {
+		return FaultConfig{}, errFaultDisabled
+	}
+
+	return kv.node.faults.getConfig(), nil
+}
+
+// AddNode 通过paxos把节点加入所有InstanceGroup
+func (kv *KVService) AddNode(ctx context.Context, nodeID int, addr string) error {
+	return kv.changeMembership(ctx, membershipChange{op: membershipAdd, nodeID: nodeID, addr: addr})
+}
+
+// RemoveNode 通过paxos把节点从所有InstanceGroup中移除
+func (kv *KVService) RemoveNode(ctx context.Context, nodeID int) error {
+	return kv.changeMembership(ctx, membershipChange{op: membershipRemove, nodeID: nodeID})
+}
+
+// changeMembership 逐个InstanceGroup提交变更，已经生效的InstanceGroup返回成功，中途失败时可以直接重试
+func (kv *KVService) changeMembership(ctx context.Context, change membershipChange) error {
+	// 移除不存在的节点在InstanceGroup中会被当成已经生效，先在这里拒绝
+	if change.op == membershipRemove && !kv.hasMember(change.nodeID) {
+		return fmt.Errorf("node %d not exists", change.nodeID)
+	}
+
+	change.delay = maxPipelineWindow
+	valueBuf := serializeSystemValue(systemMembership, serializeMembershipChange(change))
+	for _, instanceGroup := range kv.instanceGroups {
+		result, err := instanceGroup.commit(ctx, valueBuf)
+		if err != nil {
+			return err
+		}
+		if result != "ok" {
+			return errors.New(result)
+		}
+	}
+
+	return nil
+}
+
+// hasMember 节点是否在任何一个InstanceGroup的最新成员列表中
+func (kv *KVService) hasMember(nodeID int) bool {
+	for _, instanceGroup := range kv.instanceGroups {
+		if _, ok := instanceGroup.membership.getLatestNodes()[nodeID]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getKey epaxos用key判断命令是否冲突
+func (kv *KVService) getKey(val string) string {
+	kvOpInfo := unserializeOpInfo(val)
+	if kvOpInfo == nil {
+		return ""
 	}
 
-	return kvOpValue.value, kvOpValue.version
+	return kvOpInfo.key
 }
 
 func (kv *KVService) exec(val string) string {
@@ -181,6 +289,80 @@ func (kv *KVService) exec(val string) string {
 	return ""
 }
 
+// snapshot 导出属于instanceGroupID的所有key，格式为 [keyLen(4) key valueLen(4) value version(4)]...
+func (kv *KVService) snapshot(instanceGroupID int) string {
+	kv.storageLock.RLock()
+	defer kv.storageLock.RUnlock()
+
+	var buf []byte
+	var field [4]byte
+	for key, kvValue := range kv.storage {
+		if kv.getInstanceGroupID(key) != instanceGroupID {
+			continue
+		}
+
+		binary.LittleEndian.PutUint32(field[:], uint32(len(key)))
+		buf = append(buf, field[:]...)
+		buf = append(buf, key...)
+		binary.LittleEndian.PutUint32(field[:], uint32(len(kvValue.value)))
+		buf = append(buf, field[:]...)
+		buf = append(buf, kvValue.value...)
+		binary.LittleEndian.PutUint32(field[:], uint32(kvValue.version))
+		buf = append(buf, field[:]...)
+	}
+
+	return string(buf)
+}
+
+func (kv *KVService) restore(instanceGroupID int, snapshot string) error {
+	storage := make(map[string]*kvValue)
+	buf := []byte(snapshot)
+	for len(buf) > 0 {
+		if len(buf) < 4 || uint64(len(buf)-4) < uint64(binary.LittleEndian.Uint32(buf)) {
+			return errBadSnapshot
+		}
+		size := binary.LittleEndian.Uint32(buf)
+		key := string(buf[4 : 4+size])
+		buf = buf[4+size:]
+
+		if len(buf) < 4 || uint64(len(buf)-4) < uint64(binary.LittleEndian.Uint32(buf)) {
+			return errBadSnapshot
+		}
+		size = binary.LittleEndian.Uint32(buf)
+		value := string(buf[4 : 4+size])
+		buf = buf[4+size:]
+
+		if len(buf) < 4 {
+			return errBadSnapshot
+		}
+		version := int32(binary.LittleEndian.Uint32(buf))
+		buf = buf[4:]
+
+		if kv.getInstanceGroupID(key) != instanceGroupID {
+			return errBadSnapshot
+		}
+		storage[key] = &kvValue{value: value, version: version}
+	}
+
+	kv.storageLock.Lock()
+	defer kv.storageLock.Unlock()
+
+	for key := range kv.storage {
+		if kv.getInstanceGroupID(key) == instanceGroupID {
+			delete(kv.storage, key)
+		}
+	}
+	for key, value := range storage {
+		kv.storage[key] = value
+	}
+
+	return nil
+}
+
+func (kv *KVService) getInstanceGroupID(key string) int {
+	return int(djbhash(key) % uint64(len(kv.instanceGroups)))
+}
+
 func serializeOpInfo(value kvOpInfo) string {
 	return fmt.Sprintf("op=%d key=%s val=%s ver=%d", value.opType, value.key, value.value, value.version)
 }
@@ -1,71 +1,501 @@
 package main
 
 import (
+	"encoding/binary"
+	"hash/crc32"
 	"log"
+	"path/filepath"
+	"sort"
+	"sync"
 	"time"
 )
 
+// pullLearnMaxCount 一次拉取请求最多请求的instance个数，回复中value的总大小不超过一个网络帧
+const pullLearnMaxCount = 1000
+
 type learnerInstance struct {
 	instanceID  int
 	acceptValue string
 }
 
 type learner struct {
-	sm            statemachine
-	instances     map[int]*learnerInstance
-	instanceGroup *InstanceGroup
+	sm                 statemachine
+	instances          map[int]*learnerInstance
+	pendings           map[int]string // 已经选定但前面还有空缺，暂时不能执行的值
+	instanceGroup      *InstanceGroup
+	wal                *wal
+	snapshotInstanceID int // 最近一次快照包含的最大instanceID
+	snapshotData       string
+	snapshotSending    map[int]int // 正在发送快照的目标节点 -> 快照instanceID
+	snapshotSendLock   sync.Mutex  // 发送快照协程跟instance协程保护锁
+	snapshotRecv       *snapshotReceiver
+}
+
+// snapshotReceiver 正在接收的快照
+type snapshotReceiver struct {
+	from       int
+	instanceID int
+	total      int
+	crc        uint32
+	data       []byte
 }
 
 func newLearner(instanceGroup *InstanceGroup, sm statemachine) *learner {
 	l := learner{instanceGroup: instanceGroup, sm: sm}
 	l.instances = make(map[int]*learnerInstance)
+	l.pendings = make(map[int]string)
+	l.snapshotSending = make(map[int]int)
+
+	if !l.load() {
+		return nil
+	}
+
 	l.instanceGroup.tm.addTimer(PullLearnTimeout, time.Millisecond*200, l.checkLearn)
 
 	return &l
 }
 
+// load 先恢复状态机快照，再把快照之后已学习值的日志按顺序重放到状态机中，恢复到上次停止的位置
+func (l *learner) load() bool {
+	dataDir := l.instanceGroup.getDataDir()
+	if dataDir == "" {
+		return true
+	}
+
+	instanceID, data, err := loadSnapshot(filepath.Join(dataDir, "snapshot"))
+	if err != nil {
+		log.Printf("leaner: %d load snapshot error: %v", l.instanceGroup.getNodeID(), err)
+		return false
+	}
+	if instanceID != 0 {
+		err = l.restoreSnapshot(instanceID, data)
+		if err != nil {
+			log.Printf("leaner: %d restore snapshot instanceID(%d) error: %v", l.instanceGroup.getNodeID(), instanceID, err)
+			return false
+		}
+		log.Printf("leaner: %d restore snapshot instanceID(%d)", l.instanceGroup.getNodeID(), instanceID)
+	}
+
+	w, err := openWAL(filepath.Join(dataDir, "learner.wal"))
+	if err != nil {
+		log.Printf("leaner: %d open wal error: %v", l.instanceGroup.getNodeID(), err)
+		return false
+	}
+
+	err = w.replay(func(data []byte) error {
+		inst, err := unserializeLearnerInstance(data)
+		if err != nil {
+			return err
+		}
+		if inst.instanceID != l.instanceGroup.getNextInstanceID() {
+			return nil
+		}
+
+		l.instanceGroup.updateNextInstanceID()
+		l.instances[inst.instanceID] = inst
+		l.execValue(inst.instanceID, inst.acceptValue)
+		l.instanceGroup.membership.onInstanceLearned(inst.instanceID)
+		return nil
+	})
+	if err != nil {
+		log.Printf("leaner: %d replay wal error: %v", l.instanceGroup.getNodeID(), err)
+		w.close()
+		return false
+	}
+	l.wal = w
+
+	log.Printf("leaner: %d replay %d instances from wal, nextInstanceID(%d)", l.instanceGroup.getNodeID(), len(l.instances), l.instanceGroup.getNextInstanceID())
+
+	return true
+}
+
 func (l *learner) checkLearn(int) {
-	m := message{typ: PullLearnRequest, from: l.instanceGroup.getNodeID(), instanceID: l.instanceGroup.getNextInstanceID()}
-	l.instanceGroup.broadcast(m, false)
+	l.pullLearn(0)
 	l.instanceGroup.tm.addTimer(PullLearnTimeout, time.Millisecond*200, l.checkLearn)
 }
 
-func (l *learner) onValueClosed(instanceID int, value string) string {
+// pullLearn 向节点to请求从nextInstanceID开始的一段已选定的值，to为0时向其他所有节点请求
+func (l *learner) pullLearn(to int) {
+	instanceID := l.instanceGroup.getNextInstanceID()
+	m := message{typ: PullLearnRequest, from: l.instanceGroup.getNodeID(), instanceID: instanceID, endInstanceID: instanceID + pullLearnMaxCount - 1}
+	if to == 0 {
+		l.instanceGroup.broadcast(m, false)
+	} else {
+		l.instanceGroup.send(to, m)
+	}
+}
+
+func (l *learner) onValueClosed(instanceID int, value string) {
 	// 如果这个时候该节点崩溃了，此时集群中中的值是不被确定的（closed），等到下一次发起commit时，那一轮会最终确定这个值。
 	m := message{typ: PushLearn, from: l.instanceGroup.getNodeID(), instanceID: instanceID, acceptValue: value}
 	l.instanceGroup.broadcast(m, false)
 
-	return l.leanValue(m)
+	l.leanValue(m)
 }
 
-func (l *learner) leanValue(m message) string {
-	if l.instanceGroup.getNextInstanceID() != m.instanceID {
-		return ""
+// leanValue 并发提交时后面的instance可能先被选定，先缓存起来，保证严格按instanceID顺序执行
+func (l *learner) leanValue(m message) {
+	nextInstanceID := l.instanceGroup.getNextInstanceID()
+	if m.instanceID < nextInstanceID {
+		return
+	}
+
+	if m.instanceID > nextInstanceID {
+		if m.instanceID-nextInstanceID < pullLearnMaxCount {
+			l.pendings[m.instanceID] = m.acceptValue
+		}
+		return
+	}
+
+	if !l.apply(m.instanceID, m.acceptValue) {
+		return
+	}
+
+	for {
+		instanceID := l.instanceGroup.getNextInstanceID()
+		value, ok := l.pendings[instanceID]
+		if !ok {
+			break
+		}
+
+		delete(l.pendings, instanceID)
+		if !l.apply(instanceID, value) {
+			break
+		}
+	}
+}
+
+func (l *learner) apply(instanceID int, value string) bool {
+	if l.instanceGroup.node.isWitness() {
+		value = witnessValue(value)
+	}
+
+	inst := &learnerInstance{instanceID: instanceID, acceptValue: value}
+	if l.wal != nil {
+		err := l.wal.append(serializeLearnerInstance(inst))
+		if err != nil {
+			log.Printf("leaner: %d persist instanceID(%d) error: %v", l.instanceGroup.getNodeID(), instanceID, err)
+			return false
+		}
 	}
 
 	l.instanceGroup.updateNextInstanceID()
-	l.instances[m.instanceID] = &learnerInstance{instanceID: m.instanceID, acceptValue: m.acceptValue}
+	l.instances[instanceID] = inst
 
-	ret := l.sm.exec(m.acceptValue)
-	log.Printf("leaner: %d learn instanceID(%d) lean value(%s)", l.instanceGroup.getNodeID(), m.instanceID, m.acceptValue)
+	ret := l.execValue(instanceID, value)
+	l.instanceGroup.membership.onInstanceLearned(instanceID)
+	log.Printf("leaner: %d learn instanceID(%d) lean value(%s)", l.instanceGroup.getNodeID(), instanceID, value)
+
+	l.instanceGroup.proposer.onLearned(instanceID, value, ret)
+
+	return true
+}
+
+// execValue 系统值交给InstanceGroup处理，其他的交给状态机执行
+func (l *learner) execValue(instanceID int, value string) string {
+	var ret string
+	if isSystemValue(value) {
+		typ, data := unserializeSystemValue(value)
+		if typ == systemBatch {
+			// 批量提交的值逐个执行，按顺序返回每个值的结果
+			var results []string
+			_, values := unserializeBatchData(data)
+			for _, v := range values {
+				results = append(results, l.execValue(instanceID, v))
+			}
+			return serializeBatch(results)
+		}
+		ret = l.instanceGroup.execSystemValue(instanceID, value)
+	} else if value != "" {
+		ret = l.sm.exec(value)
+	}
+	l.instanceGroup.setAppliedInstanceID(instanceID)
 
 	return ret
 }
 
+// witnessValue 见证者只保留成员变更等系统值，普通的值替换成空串，不进入日志也不执行
+func witnessValue(value string) string {
+	if !isSystemValue(value) {
+		return ""
+	}
+
+	typ, data := unserializeSystemValue(value)
+	if typ != systemBatch {
+		return value
+	}
+
+	id, batch := unserializeBatchData(data)
+	var values []string
+	for _, v := range batch {
+		values = append(values, witnessValue(v))
+	}
+	return serializeBatchValue(id, values)
+}
+
 func (l *learner) onPullLearnRequest(msg message) {
+	// 见证者没有完整的值，不能作为学习的来源
+	if l.instanceGroup.node.isWitness() {
+		return
+	}
+
 	if l.instanceGroup.getNextInstanceID() <= msg.instanceID {
 		return
 	}
 
 	inst := l.instances[msg.instanceID]
 	if inst == nil {
+		// 请求的instance已经被截断，只能把快照发给对方
+		if msg.instanceID <= l.snapshotInstanceID {
+			l.sendSnapshot(msg.from)
+		}
 		return
 	}
 
-	m := message{typ: PullLearnResponse, from: l.instanceGroup.getNodeID(), instanceID: inst.instanceID, acceptValue: inst.acceptValue}
+	// 回复中的endInstanceID是本节点已学习到的最大instanceID，对方据此判断是否还需要继续拉取
+	var values []string
+	var size int
+	for instanceID := msg.instanceID; instanceID <= msg.endInstanceID; instanceID++ {
+		inst := l.instances[instanceID]
+		if inst == nil {
+			break
+		}
+
+		size += 4 + len(inst.acceptValue)
+		if len(values) > 0 && size > l.instanceGroup.getMaxValueSize() {
+			break
+		}
+		values = append(values, inst.acceptValue)
+	}
+
+	m := message{typ: PullLearnResponse, from: l.instanceGroup.getNodeID(), instanceID: msg.instanceID, endInstanceID: l.instanceGroup.getNextInstanceID() - 1}
+	m.acceptValue = serializeBatch(values)
 	l.instanceGroup.send(msg.from, m)
 }
 
-func (l *learner) onPullLearnResponse(m message) {
-	l.leanValue(m)
+func (l *learner) onPullLearnResponse(msg message) {
+	values := unserializeBatch(msg.acceptValue)
+	for i, value := range values {
+		m := message{typ: PullLearnResponse, from: msg.from, instanceID: msg.instanceID + i, acceptValue: value}
+		l.leanValue(m)
+	}
+
+	// 还落后于对方时立即继续拉取，不用等定时器
+	if l.instanceGroup.getNextInstanceID() <= msg.endInstanceID && l.instanceGroup.getNextInstanceID() > msg.instanceID {
+		l.pullLearn(msg.from)
+	}
+}
+
+// makeSnapshot 对已经执行到的位置做快照并截断之前的日志，返回快照对应的instanceID
+func (l *learner) makeSnapshot() (int, bool) {
+	instanceID := l.instanceGroup.getNextInstanceID() - 1
+	if instanceID <= l.snapshotInstanceID {
+		return 0, false
+	}
+
+	data := serializeSnapshot(l.instanceGroup.snapshotSystem(), l.sm.snapshot(l.instanceGroup.instanceGroupID))
+
+	dataDir := l.instanceGroup.getDataDir()
+	if dataDir != "" {
+		err := saveSnapshot(filepath.Join(dataDir, "snapshot"), instanceID, data)
+		if err != nil {
+			log.Printf("leaner: %d save snapshot instanceID(%d) error: %v", l.instanceGroup.getNodeID(), instanceID, err)
+			return 0, false
+		}
+	}
+
+	l.snapshotInstanceID = instanceID
+	l.snapshotData = data
+	l.compact(instanceID)
+
+	log.Printf("leaner: %d make snapshot instanceID(%d) size(%d)", l.instanceGroup.getNodeID(), instanceID, len(data))
+
+	return instanceID, true
+}
+
+// sendSnapshot 在单独的协程中把最近的快照分块发送给落后的节点，模拟模式下直接发送
+func (l *learner) sendSnapshot(to int) {
+	instanceID := l.snapshotInstanceID
+	data := l.snapshotData
+
+	l.snapshotSendLock.Lock()
+	if l.snapshotSending[to] == instanceID {
+		l.snapshotSendLock.Unlock()
+		return
+	}
+	l.snapshotSending[to] = instanceID
+	l.snapshotSendLock.Unlock()
+
+	log.Printf("leaner: %d send snapshot instanceID(%d) size(%d) to(%d)", l.instanceGroup.getNodeID(), instanceID, len(data), to)
+
+	send := func() {
+		defer func() {
+			l.snapshotSendLock.Lock()
+			delete(l.snapshotSending, to)
+			l.snapshotSendLock.Unlock()
+		}()
+
+		crc := crc32.ChecksumIEEE([]byte(data))
+		chunkSize := l.instanceGroup.getMaxValueSize() - snapshotChunkHeadSize
+		if chunkSize > snapshotChunkMaxSize {
+			chunkSize = snapshotChunkMaxSize
+		}
+
+		offset := 0
+		for {
+			end := offset + chunkSize
+			if end > len(data) {
+				end = len(data)
+			}
+
+			m := message{typ: SnapshotChunk, from: l.instanceGroup.getNodeID(), instanceID: instanceID}
+			m.acceptValue = serializeSnapshotChunk(snapshotChunk{offset: offset, total: len(data), crc: crc, data: data[offset:end]})
+			l.instanceGroup.send(to, m)
+
+			offset = end
+			if offset >= len(data) {
+				break
+			}
+		}
+	}
+
+	if l.instanceGroup.node.isStepped() {
+		send()
+	} else {
+		go send()
+	}
+}
+
+func (l *learner) onSnapshotChunk(m message) {
+	if m.instanceID < l.instanceGroup.getNextInstanceID() {
+		return
+	}
+
+	chunk, err := unserializeSnapshotChunk(m.acceptValue)
+	if err != nil {
+		log.Printf("leaner: %d bad snapshot chunk instanceID(%d) from(%d)", l.instanceGroup.getNodeID(), m.instanceID, m.from)
+		return
+	}
+	if chunk.offset == 0 {
+		l.snapshotRecv = &snapshotReceiver{from: m.from, instanceID: m.instanceID, total: chunk.total, crc: chunk.crc}
+	}
+
+	recv := l.snapshotRecv
+	if recv == nil || recv.from != m.from || recv.instanceID != m.instanceID || recv.total != chunk.total || recv.crc != chunk.crc || chunk.offset != len(recv.data) {
+		return
+	}
+
+	recv.data = append(recv.data, chunk.data...)
+	if len(recv.data) < recv.total {
+		return
+	}
+
+	l.snapshotRecv = nil
+	if crc32.ChecksumIEEE(recv.data) != recv.crc {
+		log.Printf("leaner: %d snapshot crc mismatch instanceID(%d) from(%d)", l.instanceGroup.getNodeID(), recv.instanceID, recv.from)
+		return
+	}
+	l.installSnapshot(recv.instanceID, string(recv.data))
+}
+
+// installSnapshot 用其他节点发来的快照替换本地状态，之后从快照的下一个instance继续学习
+func (l *learner) installSnapshot(instanceID int, data string) {
+	// 先恢复，快照能解析才写到磁盘上替换本地的快照
+	err := l.restoreSnapshot(instanceID, data)
+	if err != nil {
+		log.Printf("leaner: %d restore received snapshot instanceID(%d) error: %v", l.instanceGroup.getNodeID(), instanceID, err)
+		return
+	}
+
+	dataDir := l.instanceGroup.getDataDir()
+	if dataDir != "" {
+		err := saveSnapshot(filepath.Join(dataDir, "snapshot"), instanceID, data)
+		if err != nil {
+			// 不截断日志，重启后从磁盘上原来的快照跟日志恢复，再重新学习
+			log.Printf("leaner: %d save received snapshot instanceID(%d) error: %v", l.instanceGroup.getNodeID(), instanceID, err)
+			return
+		}
+	}
+
+	l.compact(instanceID)
+	l.instanceGroup.compact(instanceID)
+
+	log.Printf("leaner: %d install snapshot instanceID(%d) size(%d)", l.instanceGroup.getNodeID(), instanceID, len(data))
+}
+
+// restoreSnapshot 快照格式不对时返回错误，不修改任何状态
+func (l *learner) restoreSnapshot(instanceID int, data string) error {
+	system, sm, err := unserializeSnapshot(data)
+	if err != nil {
+		return err
+	}
+	snap, err := unserializeSystemSnapshot(system)
+	if err != nil {
+		return err
+	}
+	err = l.sm.restore(l.instanceGroup.instanceGroupID, sm)
+	if err != nil {
+		return err
+	}
+
+	l.instanceGroup.restoreSystem(snap)
+	l.snapshotInstanceID = instanceID
+	l.snapshotData = data
+	l.instanceGroup.setNextInstanceID(instanceID + 1)
+	l.instanceGroup.setAppliedInstanceID(instanceID)
+
+	return nil
+}
+
+// compact 删除instanceID及之前的已学习值
+func (l *learner) compact(instanceID int) {
+	for k := range l.pendings {
+		if k <= instanceID {
+			delete(l.pendings, k)
+		}
+	}
+
+	var ids []int
+	for k := range l.instances {
+		if k <= instanceID {
+			delete(l.instances, k)
+		} else {
+			ids = append(ids, k)
+		}
+	}
+
+	if l.wal == nil {
+		return
+	}
+
+	sort.Ints(ids)
+	records := make([][]byte, 0, len(ids))
+	for _, id := range ids {
+		records = append(records, serializeLearnerInstance(l.instances[id]))
+	}
+
+	err := l.wal.rewrite(records)
+	if err != nil {
+		log.Printf("leaner: %d compact wal instanceID(%d) error: %v", l.instanceGroup.getNodeID(), instanceID, err)
+	}
+}
+
+func serializeLearnerInstance(inst *learnerInstance) []byte {
+	buf := make([]byte, 4+len(inst.acceptValue))
+	binary.LittleEndian.PutUint32(buf[0:], uint32(inst.instanceID))
+	copy(buf[4:], inst.acceptValue)
+
+	return buf
+}
+
+func unserializeLearnerInstance(buf []byte) (*learnerInstance, error) {
+	if len(buf) < 4 {
+		return nil, errBadWALRecord
+	}
+
+	inst := &learnerInstance{}
+	inst.instanceID = int(binary.LittleEndian.Uint32(buf[0:]))
+	inst.acceptValue = string(buf[4:])
+
+	return inst, nil
 }
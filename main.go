@@ -1,19 +1,43 @@
 package main
 
 import (
+	"context"
 	"encoding/xml"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type paxosCfg struct {
 	XMLName   xml.Name      `xml:"root"`
 	NodeAddr  listenAddrCfg `xml:"listen"`
 	NodeAddrs nodeAddrCfgs  `xml:"node_list"`
+	Options   optionsCfg    `xml:"options"`
+	TLS       tlsCfg        `xml:"tls"`
+}
+
+// tlsCfg 节点之间双向TLS使用的CA、本节点的证书跟私钥，证书的DNS SAN为 node-<id>
+type tlsCfg struct {
+	CA   string `xml:"ca,attr"`
+	Cert string `xml:"cert,attr"`
+	Key  string `xml:"key,attr"`
+}
+
+type optionsCfg struct {
+	PipelineWindow int  `xml:"pipeline_window,attr"`
+	Phase1Quorum   int  `xml:"phase1_quorum,attr"`
+	Phase2Quorum   int  `xml:"phase2_quorum,attr"`
+	FastPaxos      bool `xml:"fast_paxos,attr"`
+	FastQuorum     int  `xml:"fast_quorum,attr"`
+	EPaxos         bool `xml:"epaxos,attr"`
+	MaxFrameSize   int  `xml:"max_frame_size,attr"`
+	FaultInjection bool `xml:"fault_injection,attr"`
 }
 
 type nodeAddrCfgs struct {
@@ -21,17 +45,120 @@ type nodeAddrCfgs struct {
 }
 
 type nodeAddrCfg struct {
-	Addr string `xml:"addr,attr"`
-	ID   int    `xml:"id,attr"`
+	Addr   string `xml:"addr,attr"`
+	ID     int    `xml:"id,attr"`
+	Role   string `xml:"role,attr"` // observer: 只学习不投票 witness: 只投票不保存值
+	Weight int    `xml:"weight,attr"`
 }
 
 type listenAddrCfg struct {
-	Addr   string `xml:"addr,attr"`
-	Client string `xml:"http,attr"`
-	ID     int    `xml:"id,attr"`
+	Addr    string `xml:"addr,attr"`
+	Client  string `xml:"http,attr"`
+	ID      int    `xml:"id,attr"`
+	DataDir string `xml:"data,attr"`
+}
+
+// requestContext 请求的ctx在客户端断开时结束，timeout参数(毫秒)可以再指定一个截止时间
+func requestContext(req *http.Request) (context.Context, context.CancelFunc) {
+	timeout, err := strconv.Atoi(req.FormValue("timeout"))
+	if err != nil || timeout <= 0 {
+		return context.WithCancel(req.Context())
+	}
+	return context.WithTimeout(req.Context(), time.Duration(timeout)*time.Millisecond)
+}
+
+// writeError 超时和取消用不同的状态码返回
+func writeError(w http.ResponseWriter, err error) {
+	switch err {
+	case errCommitTimeout, errReadIndexTimeout, errCommitUnknown:
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+	case errCommitCanceled:
+		http.Error(w, err.Error(), http.StatusRequestTimeout)
+	case errValueTooLarge:
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errFaultDisabled:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	}
+}
+
+// faultArgs /ADMIN/FAULTS接受的参数
+var faultArgs = map[string]bool{"reset": true, "block": true, "delay": true, "jitter": true, "drop": true, "dup": true}
+
+// parseFaultConfig 解析/ADMIN/FAULTS的参数，没有出现的参数为0。
+// 出现任何参数都会替换当前配置，拼错的参数名不能当成没有出现，否则会悄悄清掉正在注入的故障
+func parseFaultConfig(req *http.Request) (FaultConfig, error) {
+	var faults FaultConfig
+	for name := range req.Form {
+		if !faultArgs[name] {
+			return faults, errUnknownFault
+		}
+	}
+	if req.FormValue("reset") != "" {
+		return faults, nil
+	}
+
+	faults.Blocked = make(map[int]bool)
+	if block := req.FormValue("block"); block != "" {
+		for _, s := range strings.Split(block, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				return faults, errBadFaultArg
+			}
+			faults.Blocked[id] = true
+		}
+	}
+
+	for name, d := range map[string]*time.Duration{"delay": &faults.Delay, "jitter": &faults.Jitter} {
+		if s := req.FormValue(name); s != "" {
+			ms, err := strconv.Atoi(s)
+			if err != nil || ms < 0 {
+				return faults, errBadFaultArg
+			}
+			*d = time.Duration(ms) * time.Millisecond
+		}
+	}
+
+	for name, rate := range map[string]*float64{"drop": &faults.DropRate, "dup": &faults.DupRate} {
+		if s := req.FormValue(name); s != "" {
+			v, err := strconv.ParseFloat(s, 64)
+			if err != nil || v < 0 || v > 1 {
+				return faults, errBadFaultArg
+			}
+			*rate = v
+		}
+	}
+
+	return faults, nil
 }
 
 func main() {
+	// -simulate 时不启动节点，在一个进程里用虚拟时钟运行整个集群，失败时用同样的参数跟-seed重放
+	simulate := flag.Bool("simulate", false, "run deterministic simulations instead of starting a node")
+	runs := flag.Int("runs", 1, "number of simulations, seeds increase from -seed")
+	var simCfg SimulationConfig
+	flag.Int64Var(&simCfg.Seed, "seed", 0, "seed of the first simulation, 0 to use the current time")
+	flag.IntVar(&simCfg.Nodes, "nodes", 3, "number of simulated nodes")
+	flag.IntVar(&simCfg.PipelineWindow, "pipeline_window", 4, "pipeline window of simulated nodes")
+	flag.IntVar(&simCfg.Commits, "commits", 100, "number of commits in each simulation")
+	flag.DurationVar(&simCfg.Duration, "duration", time.Second*30, "virtual time with faults injected")
+	flag.DurationVar(&simCfg.MaxDelay, "delay", time.Millisecond*20, "max extra delay of a message")
+	flag.Float64Var(&simCfg.DropRate, "drop", 0.05, "probability of dropping a message")
+	flag.Float64Var(&simCfg.DupRate, "dup", 0.02, "probability of duplicating a message")
+	flag.Float64Var(&simCfg.IsolateRate, "isolate", 0.05, "probability per second of isolating a node")
+	flag.Float64Var(&simCfg.CrashRate, "crash", 0.05, "probability per second of crashing a node, restarted from its data dir")
+	flag.StringVar(&simCfg.DataDir, "sim_data", "", "data dir of simulated nodes, a temp dir is used when empty")
+	flag.BoolVar(&simCfg.Verbose, "verbose", false, "print logs and every delivered message")
+	flag.Parse()
+
+	if *simulate {
+		if !runSimulations(simCfg, *runs) {
+			os.Exit(1)
+		}
+		return
+	}
+
 	var paxosCfg paxosCfg
 	file, err := os.Open("./etc/paxos_conf.xml")
 	if err != nil {
@@ -52,11 +179,47 @@ func main() {
 	file.Close()
 
 	nodeAddrs := make(map[int]string)
+	observers := make(map[int]string)
+	witnesses := make(map[int]bool)
+	weights := make(map[int]int)
 	for i := 0; i < len(paxosCfg.NodeAddrs.Addr); i++ {
 		nodeAddr := paxosCfg.NodeAddrs.Addr[i]
-		nodeAddrs[nodeAddr.ID] = nodeAddr.Addr
+		if nodeAddr.Weight > 0 {
+			weights[nodeAddr.ID] = nodeAddr.Weight
+		}
+		if nodeAddr.Role == "observer" {
+			observers[nodeAddr.ID] = nodeAddr.Addr
+		} else {
+			nodeAddrs[nodeAddr.ID] = nodeAddr.Addr
+		}
+		if nodeAddr.Role == "witness" {
+			witnesses[nodeAddr.ID] = true
+		}
+	}
+	dataDir := paxosCfg.NodeAddr.DataDir
+	if dataDir == "" {
+		dataDir = fmt.Sprintf("./data/%d", paxosCfg.NodeAddr.ID)
+	}
+	nodeCfg := NodeConfig{NodeID: paxosCfg.NodeAddr.ID, ListenAddr: paxosCfg.NodeAddr.Addr, NodeAddrs: nodeAddrs, DataDir: dataDir}
+	nodeCfg.Observers = observers
+	nodeCfg.Witnesses = witnesses
+	nodeCfg.TLSCAFile = paxosCfg.TLS.CA
+	nodeCfg.TLSCertFile = paxosCfg.TLS.Cert
+	nodeCfg.TLSKeyFile = paxosCfg.TLS.Key
+	nodeCfg.PipelineWindow = paxosCfg.Options.PipelineWindow
+	nodeCfg.Weights = weights
+	nodeCfg.Phase1Quorum = paxosCfg.Options.Phase1Quorum
+	nodeCfg.Phase2Quorum = paxosCfg.Options.Phase2Quorum
+	nodeCfg.FastPaxos = paxosCfg.Options.FastPaxos
+	nodeCfg.FastQuorum = paxosCfg.Options.FastQuorum
+	nodeCfg.EPaxos = paxosCfg.Options.EPaxos
+	nodeCfg.MaxFrameSize = paxosCfg.Options.MaxFrameSize
+	nodeCfg.FaultInjection = paxosCfg.Options.FaultInjection
+	kvService := NewKVService(nodeCfg, 1)
+	if kvService == nil {
+		log.Printf("create kv service failed\n")
+		return
 	}
-	kvService := NewKVService(paxosCfg.NodeAddr.ID, paxosCfg.NodeAddr.Addr, nodeAddrs, 1)
 
 	http.HandleFunc("/GET_LOCAL", func(w http.ResponseWriter, req *http.Request) {
 		if req.Method != "GET" {
@@ -78,9 +241,15 @@ func main() {
 		}
 
 		req.ParseForm()
+		ctx, cancel := requestContext(req)
+		defer cancel()
 
 		key := req.FormValue("key")
-		value, version := kvService.GetGlobal(key)
+		value, version, err := kvService.GetGlobal(ctx, key)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
 		w.Write([]byte(fmt.Sprintf("[GET_GLOBAL] key: %s value: %s version: %d", key, value, version)))
 	})
 
@@ -91,6 +260,8 @@ func main() {
 		}
 
 		req.ParseForm()
+		ctx, cancel := requestContext(req)
+		defer cancel()
 
 		key := req.FormValue("key")
 		value := req.FormValue("value")
@@ -101,7 +272,11 @@ func main() {
 			return
 		}
 		_version := int32(version)
-		value, _version = kvService.Set(key, value, _version)
+		value, _version, err = kvService.Set(ctx, key, value, _version)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
 		w.Write([]byte(fmt.Sprintf("[SET] key: %s value: %s version: %d", key, value, _version)))
 	})
 
@@ -112,6 +287,8 @@ func main() {
 		}
 
 		req.ParseForm()
+		ctx, cancel := requestContext(req)
+		defer cancel()
 
 		key := req.FormValue("key")
 		version, err := strconv.Atoi(req.FormValue("version"))
@@ -120,10 +297,106 @@ func main() {
 			return
 		}
 
-		value, _version := kvService.Del(key, int32(version))
+		value, _version, err := kvService.Del(ctx, key, int32(version))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
 		w.Write([]byte(fmt.Sprintf("[DEL] key: %s value: %s version: %d", key, value, _version)))
 	})
 
+	http.HandleFunc("/ADMIN/ADD_NODE", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			http.Error(w, "The method is not allowed.", http.StatusMethodNotAllowed)
+			return
+		}
+
+		req.ParseForm()
+		ctx, cancel := requestContext(req)
+		defer cancel()
+
+		id, err := strconv.Atoi(req.FormValue("id"))
+		addr := req.FormValue("addr")
+		if err != nil || addr == "" {
+			http.Error(w, "The arg is not allowed.", http.StatusNotFound)
+			return
+		}
+
+		err = kvService.AddNode(ctx, id, addr)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Write([]byte(fmt.Sprintf("[ADD_NODE] id: %d addr: %s", id, addr)))
+	})
+
+	http.HandleFunc("/ADMIN/REMOVE_NODE", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			http.Error(w, "The method is not allowed.", http.StatusMethodNotAllowed)
+			return
+		}
+
+		req.ParseForm()
+		ctx, cancel := requestContext(req)
+		defer cancel()
+
+		id, err := strconv.Atoi(req.FormValue("id"))
+		if err != nil {
+			http.Error(w, "The arg is not allowed.", http.StatusNotFound)
+			return
+		}
+
+		err = kvService.RemoveNode(ctx, id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Write([]byte(fmt.Sprintf("[REMOVE_NODE] id: %d", id)))
+	})
+
+	http.HandleFunc("/ADMIN/STATS", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			http.Error(w, "The method is not allowed.", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Write([]byte(fmt.Sprintf("[STATS] corrupt_frames: %d", kvService.CorruptFrames())))
+	})
+
+	// 不带参数时返回当前的故障配置，带参数时整体替换，例如 block=2,3&delay=100&jitter=50&drop=0.1&dup=0.05，
+	// 时间的单位为毫秒，reset=1 清除所有故障
+	http.HandleFunc("/ADMIN/FAULTS", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			http.Error(w, "The method is not allowed.", http.StatusMethodNotAllowed)
+			return
+		}
+
+		req.ParseForm()
+		if len(req.Form) > 0 {
+			faults, err := parseFaultConfig(req)
+			if err == errUnknownFault {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				http.Error(w, "The arg is not allowed.", http.StatusNotFound)
+				return
+			}
+			err = kvService.SetFaults(faults)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+		}
+
+		faults, err := kvService.Faults()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Write([]byte(fmt.Sprintf("[FAULTS] %s", faults)))
+	})
+
 	err = http.ListenAndServe(paxosCfg.NodeAddr.Client, nil)
 	if err != nil {
 		fmt.Printf("ListenAndServe error: %s %s", err, paxosCfg.NodeAddr.Client)
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	masterLeaseTime     = time.Second * 5
+	masterCheckInterval = time.Second
+	// masterLeaseMargin acceptor在租期之外多拒绝其他节点的时间，覆盖节点之间的时钟漂移，
+	// master自己按发起选主的时间计算租期，在其他节点放行之前就已经到期
+	masterLeaseMargin = time.Millisecond * 500
+)
+
+var errNotMaster = errors.New("not master")
+
+// masterInfo 选主时提交的系统值，version是发起时本节点看到的当前master的选出instanceID，
+// 只有version跟学习时的masterVersion一致才生效，避免过期的选主覆盖新的结果。
+// tryTime是发起的时间(UnixNano)，同时用来区分同一个节点的多次选主
+type masterInfo struct {
+	nodeID  int
+	version int
+	tryTime int64
+}
+
+// masterMgr 每个InstanceGroup一个，通过paxos选出master并定期续约租期
+type masterMgr struct {
+	instanceGroup *InstanceGroup
+	lock          sync.Mutex // 选主协程、instance协程跟commit协程保护锁
+	masterNodeID  int
+	masterVersion int
+	expireTime    time.Time
+	tries         map[int64]bool // 本节点在当前masterVersion下发起的选主，master自己的租期从对应的发起时间算起，比其他节点看到的更早过期
+	readIndex     int            // 自己当选时接受选主值的多数派接受过的最大instanceID，为0时不能在租期内直接读本地
+	pending       *commitRequest // 模拟模式下还没有结果的选主请求
+	pendingTime   time.Time
+}
+
+func newMasterMgr(instanceGroup *InstanceGroup) *masterMgr {
+	return &masterMgr{instanceGroup: instanceGroup, tries: make(map[int64]bool)}
+}
+
+func (mm *masterMgr) run() {
+	for {
+		mm.tryBeMaster()
+		time.Sleep(masterCheckInterval)
+	}
+}
+
+// tryBeMaster 没有有效的master时尝试成为master，自己是master时在租期过半后续约
+func (mm *masterMgr) tryBeMaster() {
+	value, ok := mm.check()
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), masterLeaseTime)
+	defer cancel()
+
+	_, err := mm.instanceGroup.proposer.commit(ctx, value)
+	if err != nil {
+		log.Printf("master: %d try be master error: %v", mm.instanceGroup.getNodeID(), err)
+	}
+}
+
+// step 模拟模式下由模拟器每隔masterCheckInterval调用，不等待提交的结果，
+// 跟tryBeMaster一样同时最多只有一个选主请求
+func (mm *masterMgr) step() {
+	if mm.pending != nil {
+		select {
+		case <-mm.pending.result:
+		default:
+			if mm.instanceGroup.now().Sub(mm.pendingTime) < masterLeaseTime {
+				return
+			}
+			log.Printf("master: %d try be master error: %v", mm.instanceGroup.getNodeID(), errCommitTimeout)
+			mm.instanceGroup.proposer.cancelRequest(mm.pending)
+		}
+		mm.pending = nil
+	}
+
+	value, ok := mm.check()
+	if !ok {
+		return
+	}
+
+	req, err := mm.instanceGroup.proposer.submit(value)
+	if err != nil {
+		log.Printf("master: %d try be master error: %v", mm.instanceGroup.getNodeID(), err)
+		return
+	}
+	mm.pending = req
+	mm.pendingTime = mm.instanceGroup.now()
+}
+
+// check 判断是否需要发起选主，需要时返回要提交的系统值
+func (mm *masterMgr) check() (string, bool) {
+	now := mm.instanceGroup.now()
+	nodeID := mm.instanceGroup.getNodeID()
+
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+
+	if mm.masterNodeID != nodeID && now.Before(mm.expireTime) {
+		return "", false
+	}
+	if mm.masterNodeID == nodeID && mm.expireTime.Sub(now) > masterLeaseTime/2 {
+		return "", false
+	}
+	// 超时放弃的选主仍然可能在之后被选定，每次发起都记录自己的时间，学习到时按值里的时间计算租期
+	info := masterInfo{nodeID: nodeID, version: mm.masterVersion, tryTime: now.UnixNano()}
+	mm.tries[info.tryTime] = true
+
+	return serializeSystemValue(systemMaster, serializeMasterInfo(info)), true
+}
+
+// onLearn 学习到选主的系统值，在instance协程中调用
+func (mm *masterMgr) onLearn(instanceID int, data string) string {
+	info, err := unserializeMasterInfo(data)
+	if err != nil {
+		log.Printf("master: %d bad master info instanceID(%d)", mm.instanceGroup.getNodeID(), instanceID)
+		return ""
+	}
+
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+
+	if info.version != mm.masterVersion {
+		log.Printf("master: %d ignore stale master(%d) instanceID(%d) version(%d) masterVersion(%d)", mm.instanceGroup.getNodeID(), info.nodeID, instanceID, info.version, mm.masterVersion)
+		return ""
+	}
+
+	now := mm.instanceGroup.now()
+	mm.readIndex = 0
+	if info.nodeID == mm.instanceGroup.getNodeID() {
+		if mm.tries[info.tryTime] {
+			mm.expireTime = time.Unix(0, info.tryTime).Add(masterLeaseTime)
+			// 选主值经本节点的多数派选定时才知道需要执行到哪里，被其他节点恢复选定的不能直接读本地
+			mm.readIndex = mm.instanceGroup.proposer.getQuorumAcceptedID(instanceID)
+		} else {
+			// 重启前发起的选主，租期的起点已经不可知，不能认为自己是master
+			mm.expireTime = time.Time{}
+		}
+	} else {
+		mm.expireTime = now.Add(masterLeaseTime)
+	}
+
+	if mm.masterNodeID != info.nodeID {
+		log.Printf("master: %d master changed from(%d) to(%d) instanceID(%d)", mm.instanceGroup.getNodeID(), mm.masterNodeID, info.nodeID, instanceID)
+	}
+	mm.masterNodeID = info.nodeID
+	mm.masterVersion = instanceID
+	// 之前发起的选主version都已经过期，学习到也不会生效
+	mm.tries = make(map[int64]bool)
+
+	return ""
+}
+
+// getMaster 返回租期内的master，没有有效的master时返回0
+func (mm *masterMgr) getMaster() int {
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+
+	if mm.instanceGroup.now().After(mm.expireTime) {
+		return 0
+	}
+
+	return mm.masterNodeID
+}
+
+func (mm *masterMgr) isMaster() bool {
+	return mm.getMaster() == mm.instanceGroup.getNodeID()
+}
+
+// getLease 返回学习到的master、选出它的instanceID跟租期的到期时间，acceptor据此拒绝其他节点
+func (mm *masterMgr) getLease() (int, int, time.Time) {
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+
+	return mm.masterNodeID, mm.masterVersion, mm.expireTime
+}
+
+// getReadIndex 自己是租期内的master时，返回执行到哪里之后可以直接读本地，以及当选的instanceID
+func (mm *masterMgr) getReadIndex() (int, int, bool) {
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+
+	if mm.masterNodeID != mm.instanceGroup.getNodeID() || mm.readIndex == 0 || !mm.instanceGroup.now().Before(mm.expireTime) {
+		return 0, 0, false
+	}
+
+	return mm.readIndex, mm.masterVersion, true
+}
+
+func (mm *masterMgr) snapshot() string {
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+
+	return serializeMasterInfo(masterInfo{nodeID: mm.masterNodeID, version: mm.masterVersion})
+}
+
+// restore 从快照恢复master，其他节点的租期从现在重新算起，自己则需要重新选主
+func (mm *masterMgr) restore(info masterInfo) {
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+
+	mm.masterNodeID = info.nodeID
+	mm.masterVersion = info.version
+	mm.tries = make(map[int64]bool)
+	mm.readIndex = 0
+	mm.expireTime = time.Time{}
+	if info.nodeID != mm.instanceGroup.getNodeID() {
+		mm.expireTime = mm.instanceGroup.now().Add(masterLeaseTime)
+	}
+}
+
+// masterInfoOf 从值里找出选主的系统值，值可能是打包值
+func masterInfoOf(value string) (masterInfo, bool) {
+	if !isSystemValue(value) {
+		return masterInfo{}, false
+	}
+
+	typ, data := unserializeSystemValue(value)
+	switch typ {
+	case systemBatch:
+		_, values := unserializeBatchData(data)
+		for _, v := range values {
+			if info, ok := masterInfoOf(v); ok {
+				return info, true
+			}
+		}
+	case systemMaster:
+		info, err := unserializeMasterInfo(data)
+		return info, err == nil
+	}
+
+	return masterInfo{}, false
+}
+
+// serializeMasterInfo 格式为 nodeID(4) version(4) tryTime(8)，快照里不需要tryTime
+func serializeMasterInfo(info masterInfo) string {
+	var buf [16]byte
+	binary.LittleEndian.PutUint32(buf[0:], uint32(info.nodeID))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(info.version))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(info.tryTime))
+
+	return string(buf[:])
+}
+
+func unserializeMasterInfo(data string) (masterInfo, error) {
+	var info masterInfo
+	if len(data) != 8 && len(data) != 16 {
+		return info, errBadSnapshot
+	}
+
+	buf := []byte(data)
+	info.nodeID = int(binary.LittleEndian.Uint32(buf[0:]))
+	info.version = int(binary.LittleEndian.Uint32(buf[4:]))
+	if len(buf) >= 16 {
+		info.tryTime = int64(binary.LittleEndian.Uint64(buf[8:]))
+	}
+
+	return info, nil
+}
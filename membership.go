@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+)
+
+const (
+	membershipAdd int = iota + 1
+	membershipRemove
+)
+
+// maxPipelineWindow 所有节点pipeline窗口的上限，成员变更在选定之后推迟这么多个instance生效，
+// 各个节点的窗口可以配置得不同，推迟的距离不能依赖本地的配置。没有写入时靠master续约推进instance，所以不宜太大
+const maxPipelineWindow = 16
+
+// membershipChange 成员变更的系统值，delay是从选定的instanceID到生效的距离，由发起者写进值里，
+// 所有节点学习到的生效位置因此一致
+type membershipChange struct {
+	op     int
+	nodeID int
+	delay  int
+	addr   string
+}
+
+// membershipConfig 从instanceID开始生效的成员列表
+type membershipConfig struct {
+	instanceID int
+	nodes      map[int]string
+}
+
+// membership 每个InstanceGroup的成员列表，通过paxos提交变更。
+// 在instanceID被选定的变更从instanceID+delay开始生效，delay不小于任何节点的pipeline窗口，保证并发中的instance不会受影响
+type membership struct {
+	instanceGroup *InstanceGroup
+	lock          sync.RWMutex // instance协程跟读协程保护锁
+	configs       []membershipConfig
+}
+
+func newMembership(instanceGroup *InstanceGroup, nodes map[int]string) *membership {
+	ms := &membership{instanceGroup: instanceGroup}
+	ms.configs = []membershipConfig{{instanceID: 1, nodes: copyNodes(nodes)}}
+
+	return ms
+}
+
+// getNodes 返回instanceID对应的成员列表，调用者不能修改
+func (ms *membership) getNodes(instanceID int) map[int]string {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	nodes := ms.configs[0].nodes
+	for _, config := range ms.configs {
+		if config.instanceID > instanceID {
+			break
+		}
+		nodes = config.nodes
+	}
+
+	return nodes
+}
+
+// getLatestNodes 返回包括还没生效的变更在内的最新成员列表
+func (ms *membership) getLatestNodes() map[int]string {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	return ms.configs[len(ms.configs)-1].nodes
+}
+
+// getStableNodes 从instanceID开始成员没有变化，也没有还没生效的变更时返回成员列表
+func (ms *membership) getStableNodes(instanceID int) (map[int]string, bool) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	if len(ms.configs) != 1 || ms.configs[0].instanceID > instanceID {
+		return nil, false
+	}
+
+	return ms.configs[0].nodes, true
+}
+
+// getAllNodes 返回还保留着的所有配置中成员的并集。被移除的节点在变更生效之前仍然参与投票，
+// 网络连接要等到旧配置不再需要时才能断开
+func (ms *membership) getAllNodes() map[int]string {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	nodes := make(map[int]string)
+	for _, config := range ms.configs {
+		for k, v := range config.nodes {
+			nodes[k] = v
+		}
+	}
+
+	return nodes
+}
+
+// onInstanceLearned 学习到instanceID之后删除不再需要的旧配置，有删除时同步网络连接
+func (ms *membership) onInstanceLearned(instanceID int) {
+	ms.lock.Lock()
+	count := len(ms.configs)
+	ms.compact(instanceID)
+	changed := len(ms.configs) != count
+	ms.lock.Unlock()
+
+	if changed {
+		ms.syncNetwork()
+	}
+}
+
+// onLearn 学习到成员变更，在instance协程中调用，返回变更结果
+func (ms *membership) onLearn(instanceID int, data string) string {
+	change := unserializeMembershipChange(data)
+	if change.delay < 1 {
+		return fmt.Sprintf("bad membership change delay(%d)", change.delay)
+	}
+
+	ms.lock.Lock()
+	latest := ms.configs[len(ms.configs)-1]
+	addr, exist := latest.nodes[change.nodeID]
+	// 变更逐个InstanceGroup提交，中途失败后重试时已经生效的InstanceGroup直接返回成功
+	if (change.op == membershipAdd && exist && addr == change.addr) || (change.op == membershipRemove && !exist) {
+		ms.lock.Unlock()
+		log.Printf("membership: %d instanceID(%d) op(%d) node(%d) already applied", ms.instanceGroup.getNodeID(), instanceID, change.op, change.nodeID)
+		return "ok"
+	}
+	if change.op == membershipAdd && exist {
+		ms.lock.Unlock()
+		return fmt.Sprintf("node %d already exists", change.nodeID)
+	}
+
+	nodes := copyNodes(latest.nodes)
+	if change.op == membershipAdd {
+		nodes[change.nodeID] = change.addr
+	} else {
+		delete(nodes, change.nodeID)
+	}
+
+	err := ms.instanceGroup.getQuorumConfig().validate(nodes)
+	if err != nil {
+		ms.lock.Unlock()
+		return err.Error()
+	}
+
+	effectiveID := instanceID + change.delay
+	ms.configs = append(ms.configs, membershipConfig{instanceID: effectiveID, nodes: nodes})
+	ms.compact(instanceID)
+	ms.lock.Unlock()
+
+	log.Printf("membership: %d instanceID(%d) op(%d) node(%d) addr(%s) effective from instanceID(%d)", ms.instanceGroup.getNodeID(), instanceID, change.op, change.nodeID, change.addr, effectiveID)
+
+	ms.syncNetwork()
+
+	return "ok"
+}
+
+// compact 删除已经被后面的配置取代的配置，调用者需要持有锁
+func (ms *membership) compact(instanceID int) {
+	i := 0
+	for i+1 < len(ms.configs) && ms.configs[i+1].instanceID <= instanceID {
+		i++
+	}
+	ms.configs = ms.configs[i:]
+}
+
+// snapshot 格式为 [instanceID(4) count(4) [nodeID(4) addrSize(4) addr]...]...
+func (ms *membership) snapshot() string {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	var buf []byte
+	var field [4]byte
+	for _, config := range ms.configs {
+		binary.LittleEndian.PutUint32(field[:], uint32(config.instanceID))
+		buf = append(buf, field[:]...)
+		binary.LittleEndian.PutUint32(field[:], uint32(len(config.nodes)))
+		buf = append(buf, field[:]...)
+
+		ids := make([]int, 0, len(config.nodes))
+		for id := range config.nodes {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+
+		for _, id := range ids {
+			binary.LittleEndian.PutUint32(field[:], uint32(id))
+			buf = append(buf, field[:]...)
+			binary.LittleEndian.PutUint32(field[:], uint32(len(config.nodes[id])))
+			buf = append(buf, field[:]...)
+			buf = append(buf, config.nodes[id]...)
+		}
+	}
+
+	return string(buf)
+}
+
+// restore 用快照中解析出的配置替换成员列表
+func (ms *membership) restore(configs []membershipConfig) {
+	ms.lock.Lock()
+	ms.configs = configs
+	ms.lock.Unlock()
+
+	ms.syncNetwork()
+}
+
+// syncNetwork 启动过程中重放日志时InstanceGroup还没有注册到node，等注册后再统一同步
+func (ms *membership) syncNetwork() {
+	node := ms.instanceGroup.node
+	if node.getInstanceGroup(ms.instanceGroup.instanceGroupID) != ms.instanceGroup {
+		return
+	}
+
+	node.syncNetwork()
+}
+
+// unserializeMembershipConfigs 解析snapshot的结果，长度不对或者没有任何配置时返回错误
+func unserializeMembershipConfigs(data string) ([]membershipConfig, error) {
+	var configs []membershipConfig
+	buf := []byte(data)
+	for len(buf) > 0 {
+		if len(buf) < 8 {
+			return nil, errBadSnapshot
+		}
+		config := membershipConfig{nodes: make(map[int]string)}
+		config.instanceID = int(binary.LittleEndian.Uint32(buf[0:]))
+		count := int(binary.LittleEndian.Uint32(buf[4:]))
+		buf = buf[8:]
+
+		for i := 0; i < count; i++ {
+			if len(buf) < 8 {
+				return nil, errBadSnapshot
+			}
+			id := int(binary.LittleEndian.Uint32(buf[0:]))
+			size := int(binary.LittleEndian.Uint32(buf[4:]))
+			if len(buf)-8 < size {
+				return nil, errBadSnapshot
+			}
+			config.nodes[id] = string(buf[8 : 8+size])
+			buf = buf[8+size:]
+		}
+		configs = append(configs, config)
+	}
+
+	if len(configs) == 0 {
+		return nil, errBadSnapshot
+	}
+
+	return configs, nil
+}
+
+func copyNodes(nodes map[int]string) map[int]string {
+	newNodes := make(map[int]string, len(nodes))
+	for k, v := range nodes {
+		newNodes[k] = v
+	}
+
+	return newNodes
+}
+
+// serializeMembershipChange 格式为 op(4) nodeID(4) delay(4) addr
+func serializeMembershipChange(change membershipChange) string {
+	buf := make([]byte, 12+len(change.addr))
+	binary.LittleEndian.PutUint32(buf[0:], uint32(change.op))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(change.nodeID))
+	binary.LittleEndian.PutUint32(buf[8:], uint32(change.delay))
+	copy(buf[12:], change.addr)
+
+	return string(buf)
+}
+
+func unserializeMembershipChange(data string) membershipChange {
+	var change membershipChange
+	if len(data) < 12 {
+		return change
+	}
+
+	buf := []byte(data)
+	change.op = int(binary.LittleEndian.Uint32(buf[0:]))
+	change.nodeID = int(binary.LittleEndian.Uint32(buf[4:]))
+	change.delay = int(binary.LittleEndian.Uint32(buf[8:]))
+	change.addr = string(buf[12:])
+
+	return change
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// memoryQueueSize 每个节点接收队列的长度，队列满了就丢弃消息，跟网络丢包一样由paxos重试
+const memoryQueueSize = 1024
+
+// MemoryHub 同一个进程里的节点通过它找到对方的接收队列
+type MemoryHub struct {
+	networks map[int]*MemoryNetwork
+	lock     sync.RWMutex
+}
+
+func NewMemoryHub() *MemoryHub {
+	return &MemoryHub{networks: make(map[int]*MemoryNetwork)}
+}
+
+func (hub *MemoryHub) getNetwork(id int) *MemoryNetwork {
+	hub.lock.RLock()
+	defer hub.lock.RUnlock()
+
+	return hub.networks[id]
+}
+
+// MemoryNetwork 进程内的Transport实现，消息直接放进对方的接收队列，
+// 用于在一个进程里运行整个集群做测试或者嵌入使用
+type MemoryNetwork struct {
+	nodeID       int
+	hub          *MemoryHub
+	nodeAddrs    map[int]string
+	nodesLock    sync.RWMutex // 成员变更时增删节点的保护锁
+	recvQueue    chan message
+	maxFrameSize int
+	closed       uint32
+}
+
+func NewMemoryNetwork(hub *MemoryHub, nodeID int, maxFrameSize int) *MemoryNetwork {
+	if maxFrameSize <= 0 {
+		maxFrameSize = defaultMaxFrameSize
+	}
+	if maxFrameSize < minMaxFrameSize {
+		log.Printf("max frame size(%d) too small", maxFrameSize)
+		return nil
+	}
+
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+
+	if _, ok := hub.networks[nodeID]; ok {
+		log.Printf("memory network: node(%d) already exists", nodeID)
+		return nil
+	}
+
+	network := &MemoryNetwork{nodeID: nodeID, hub: hub, maxFrameSize: maxFrameSize}
+	network.nodeAddrs = make(map[int]string)
+	network.recvQueue = make(chan message, memoryQueueSize)
+	hub.networks[nodeID] = network
+
+	return network
+}
+
+// close 从hub注销，之后这个节点收不到也发不出任何消息，跟进程退出一样。
+// 注销后可以用同一个nodeID创建新的MemoryNetwork，在进程内模拟节点重启
+func (network *MemoryNetwork) close() {
+	atomic.StoreUint32(&network.closed, 1)
+
+	network.hub.lock.Lock()
+	defer network.hub.lock.Unlock()
+
+	if network.hub.networks[network.nodeID] == network {
+		delete(network.hub.networks, network.nodeID)
+	}
+}
+
+func (network *MemoryNetwork) addNode(id int, addr string) {
+	network.nodesLock.Lock()
+	defer network.nodesLock.Unlock()
+
+	network.nodeAddrs[id] = addr
+}
+
+func (network *MemoryNetwork) removeNode(id int) {
+	network.nodesLock.Lock()
+	defer network.nodesLock.Unlock()
+
+	delete(network.nodeAddrs, id)
+}
+
+func (network *MemoryNetwork) getNodeIDs() []int {
+	network.nodesLock.RLock()
+	defer network.nodesLock.RUnlock()
+
+	ids := make([]int, 0, len(network.nodeAddrs))
+	for id := range network.nodeAddrs {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+// getMaxValueSize 跟TCP一样取自己跟其他节点的帧长度上限中最小的
+func (network *MemoryNetwork) getMaxValueSize() int {
+	size := network.maxFrameSize
+	for _, id := range network.getNodeIDs() {
+		peer := network.hub.getNetwork(id)
+		if peer != nil && peer.maxFrameSize < size {
+			size = peer.maxFrameSize
+		}
+	}
+
+	return size - frameHeadSize - frameFieldsSize
+}
+
+func (network *MemoryNetwork) send(id int, m message) {
+	if atomic.LoadUint32(&network.closed) != 0 {
+		return
+	}
+
+	network.nodesLock.RLock()
+	_, ok := network.nodeAddrs[id]
+	network.nodesLock.RUnlock()
+	if !ok {
+		return
+	}
+
+	peer := network.hub.getNetwork(id)
+	if peer == nil {
+		return
+	}
+
+	// 跟TCP一样，超过对方帧长度上限的消息直接丢弃
+	if frameHeadSize+frameFieldsSize+len(m.acceptValue) > peer.maxFrameSize {
+		log.Printf("frame too large(%d) type: %d id: %d, dropped", frameHeadSize+frameFieldsSize+len(m.acceptValue), m.typ, id)
+		return
+	}
+
+	select {
+	case peer.recvQueue <- m:
+	default:
+		log.Printf("memory network: queue of node(%d) is full, drop message type(%d)", id, m.typ)
+	}
+}
+
+// response 进程内没有主动跟被动连接的区别，跟send一样
+func (network *MemoryNetwork) response(id int, m message) {
+	network.send(id, m)
+}
+
+func (network *MemoryNetwork) recv(timeout time.Duration) (message, bool) {
+	if atomic.LoadUint32(&network.closed) != 0 {
+		time.Sleep(timeout)
+		return message{}, false
+	}
+
+	select {
+	case m := <-network.recvQueue:
+		return m, true
+	case <-time.After(timeout):
+		return message{}, false
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newMemoryKVService(t *testing.T, hub *MemoryHub, nodeID int, nodeAddrs map[int]string, dataDir string) *KVService {
+	network := NewMemoryNetwork(hub, nodeID, 0)
+	if network == nil {
+		t.Fatalf("create memory network %d failed", nodeID)
+	}
+
+	cfg := NodeConfig{NodeID: nodeID, NodeAddrs: nodeAddrs, DataDir: dataDir, PipelineWindow: 4, Transport: network}
+	kv := NewKVService(cfg, 2)
+	if kv == nil {
+		t.Fatalf("create node %d failed", nodeID)
+	}
+
+	return kv
+}
+
+// setWithRetry 刚启动时还没有master，提交可能失败，重试直到成功
+func setWithRetry(t *testing.T, kv *KVService, key string, value string) {
+	deadline := time.Now().Add(time.Second * 20)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		_, _, err := kv.Set(ctx, key, value, 0)
+		cancel()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("set %s failed: %v", key, err)
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
+func checkGlobal(t *testing.T, kv *KVService, key string, want string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	value, _, err := kv.GetGlobal(ctx, key)
+	if err != nil {
+		t.Fatalf("node %d get %s failed: %v", kv.node.getNodeID(), key, err)
+	}
+	if value != want {
+		t.Fatalf("node %d get %s = %q, want %q", kv.node.getNodeID(), key, value, want)
+	}
+}
+
+// copyDir 复制节点的数据目录，模拟进程崩溃时磁盘上的状态
+func copyDir(t *testing.T, src string, dst string) {
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		_, err = io.Copy(out, in)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("copy %s failed: %v", src, err)
+	}
+}
+
+func TestMemoryNetworkCluster(t *testing.T) {
+	hub := NewMemoryHub()
+	nodeAddrs := map[int]string{1: "memory-1", 2: "memory-2", 3: "memory-3"}
+	dataDirs := make(map[int]string)
+	kvs := make(map[int]*KVService)
+	for id := range nodeAddrs {
+		dataDirs[id] = t.TempDir()
+		kvs[id] = newMemoryKVService(t, hub, id, nodeAddrs, dataDirs[id])
+	}
+
+	for i := 0; i < 10; i++ {
+		setWithRetry(t, kvs[i%3+1], fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+	}
+	for id := range nodeAddrs {
+		for i := 0; i < 10; i++ {
+			checkGlobal(t, kvs[id], fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+		}
+	}
+
+	// 重启节点3：注销旧的网络后旧节点不再收发消息，新节点从复制出来的数据目录恢复
+	baseTransport(kvs[3].node.network).(*MemoryNetwork).close()
+	if NewMemoryNetwork(hub, 1, 0) != nil {
+		t.Fatalf("duplicate node id should be rejected")
+	}
+	restartDir := t.TempDir()
+	copyDir(t, dataDirs[3], restartDir)
+
+	setWithRetry(t, kvs[1], "key10", "value10")
+
+	kvs[3] = newMemoryKVService(t, hub, 3, nodeAddrs, restartDir)
+	for i := 0; i < 11; i++ {
+		checkGlobal(t, kvs[3], fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+	}
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"log"
 	"net"
@@ -13,41 +15,156 @@ import (
 	"time"
 )
 
+// frameHeadSize 每个帧的头部为 size(4) + crc32c(4)，size包括头部；frameFieldsSize 消息中定长字段的长度
+// defaultMaxFrameSize 没有配置时帧长度的上限，建立连接时双方交换各自的上限，发送时按对方的上限检查
+const (
+	frameHeadSize       = 8
+	frameFieldsSize     = 36
+	defaultMaxFrameSize = 4 << 20
+	minMaxFrameSize     = frameHeadSize + frameFieldsSize + 1024
+)
+
+var frameCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
 type NodeNetwork struct {
-	nodeID     int
-	listenAddr string
-	nodeAddrs  map[int]string
-	recvQueue  chan message
-	nodeConns1 map[int]*NodeConn // 主动发起的连接
-	nodeConns2 map[int]*NodeConn // 被动接受的连接
+	nodeID        int
+	listenAddr    string
+	nodeAddrs     map[int]string
+	recvQueue     chan message
+	nodeConns1    map[int]*NodeConn // 主动发起的连接
+	nodeConns2    map[int]*NodeConn // 被动接受的连接
+	connsLock     sync.RWMutex      // 成员变更时增删连接的保护锁
+	corruptFrames uint64            // 校验失败被丢弃的帧数
+	tls           *peerTLS          // 为nil时使用明文TCP
+	maxFrameSize  int               // 单个帧长度的上限，包括头部
+	peerFrameSize map[int]int       // 握手时得到的各个节点的帧长度上限，connsLock保护
 }
 
-func NewNodeNetwork(nodeID int, listenAddr string, nodeAddrs map[int]string) *NodeNetwork {
-	network := NodeNetwork{nodeID: nodeID, listenAddr: listenAddr, nodeAddrs: nodeAddrs}
+func NewNodeNetwork(nodeID int, listenAddr string, nodeAddrs map[int]string, tlsConfig *peerTLS, maxFrameSize int) *NodeNetwork {
+	if maxFrameSize <= 0 {
+		maxFrameSize = defaultMaxFrameSize
+	}
+	if maxFrameSize < minMaxFrameSize {
+		log.Printf("max frame size(%d) too small", maxFrameSize)
+		return nil
+	}
+
+	network := NodeNetwork{nodeID: nodeID, listenAddr: listenAddr, tls: tlsConfig, maxFrameSize: maxFrameSize}
 
 	listen, err := net.Listen("tcp", listenAddr)
 	if err != nil {
 		log.Printf("error listening: %s", err)
 		return nil
 	}
+	if tlsConfig != nil {
+		listen = tls.NewListener(listen, tlsConfig.server)
+	}
 
 	network.recvQueue = make(chan message)
 	network.nodeConns1 = make(map[int]*NodeConn)
 	network.nodeConns2 = make(map[int]*NodeConn)
+	network.peerFrameSize = make(map[int]int)
 
 	go network.accept(listen)
 
+	network.nodeAddrs = make(map[int]string)
 	for k, v := range nodeAddrs {
-		nodeConn1 := newNodeConn(k, v, true, &network)
-		network.nodeConns1[k] = nodeConn1
-
-		nodeConn2 := newNodeConn(k, v, false, &network)
-		network.nodeConns2[k] = nodeConn2
+		network.addNode(k, v)
 	}
 
 	return &network
 }
 
+// addNode 增加一个节点并开始连接
+func (network *NodeNetwork) addNode(id int, addr string) {
+	network.connsLock.Lock()
+	defer network.connsLock.Unlock()
+
+	if _, ok := network.nodeAddrs[id]; ok {
+		return
+	}
+
+	network.nodeAddrs[id] = addr
+	network.nodeConns1[id] = newNodeConn(id, addr, true, network)
+	network.nodeConns2[id] = newNodeConn(id, addr, false, network)
+}
+
+// removeNode 删除一个节点并关闭跟它的连接
+func (network *NodeNetwork) removeNode(id int) {
+	network.connsLock.Lock()
+	defer network.connsLock.Unlock()
+
+	if _, ok := network.nodeAddrs[id]; !ok {
+		return
+	}
+
+	network.nodeConns1[id].close()
+	network.nodeConns2[id].close()
+	delete(network.nodeAddrs, id)
+	delete(network.nodeConns1, id)
+	delete(network.nodeConns2, id)
+	delete(network.peerFrameSize, id)
+}
+
+// setPeerFrameSize 记录握手时对方声明的帧长度上限
+func (network *NodeNetwork) setPeerFrameSize(id int, size int) {
+	network.connsLock.Lock()
+	defer network.connsLock.Unlock()
+
+	if _, ok := network.nodeAddrs[id]; !ok {
+		return
+	}
+
+	if size != network.peerFrameSize[id] {
+		log.Printf("node %d max frame size: %d", id, size)
+	}
+	network.peerFrameSize[id] = size
+}
+
+// getMaxValueSize 一个消息里acceptValue的长度上限，取自己跟所有已经握手的节点的帧长度上限中最小的，
+// 这样提交时就拒绝集群里有节点收不了的值，而不是发出去以后一直被对方当成损坏的帧
+func (network *NodeNetwork) getMaxValueSize() int {
+	network.connsLock.RLock()
+	defer network.connsLock.RUnlock()
+
+	size := network.maxFrameSize
+	for _, s := range network.peerFrameSize {
+		if s < size {
+			size = s
+		}
+	}
+
+	return size - frameHeadSize - frameFieldsSize
+}
+
+// getCorruptFrames 返回校验失败被丢弃的帧数
+func (network *NodeNetwork) getCorruptFrames() uint64 {
+	return atomic.LoadUint64(&network.corruptFrames)
+}
+
+func (network *NodeNetwork) getNodeIDs() []int {
+	network.connsLock.RLock()
+	defer network.connsLock.RUnlock()
+
+	ids := make([]int, 0, len(network.nodeAddrs))
+	for k := range network.nodeAddrs {
+		ids = append(ids, k)
+	}
+
+	return ids
+}
+
+func (network *NodeNetwork) getNodeConn(id int, active bool) *NodeConn {
+	network.connsLock.RLock()
+	defer network.connsLock.RUnlock()
+
+	if active {
+		return network.nodeConns1[id]
+	}
+
+	return network.nodeConns2[id]
+}
+
 func (network *NodeNetwork) accept(listen net.Listener) {
 	defer listen.Close()
 
@@ -58,41 +175,72 @@ func (network *NodeNetwork) accept(listen net.Listener) {
 			continue
 		}
 
-		var buf [4]byte
-		_, err = io.ReadFull(conn, buf[:])
-		if err != nil {
-			log.Printf("io.ReadFull failed: %s", err)
-			conn.Close()
-			continue
-		}
+		go network.handshake(conn)
+	}
+}
+
+// handshake 在每个连接自己的协程里读取对端的nodeID跟帧长度上限并完成TLS握手，慢的或者恶意的连接不会阻塞accept
+func (network *NodeNetwork) handshake(conn net.Conn) {
+	var buf [8]byte
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	_, err := io.ReadFull(conn, buf[:])
+	if err != nil {
+		log.Printf("io.ReadFull failed: %s", err)
+		conn.Close()
+		return
+	}
 
-		id := int(binary.LittleEndian.Uint32(buf[:]))
-		log.Printf("accept id %d", id)
+	id := int(binary.LittleEndian.Uint32(buf[:]))
+	peerFrameSize := int(binary.LittleEndian.Uint32(buf[4:]))
+	log.Printf("accept id %d", id)
 
-		nodeConn := network.nodeConns2[id]
-		if nodeConn == nil {
-			log.Printf("nw.nodeConns2[%d] == nil", id)
-			conn.Close()
-			continue
-		}
+	if peerFrameSize < minMaxFrameSize {
+		log.Printf("accept id %d: max frame size(%d) too small", id, peerFrameSize)
+		conn.Close()
+		return
+	}
 
-		if !atomic.CompareAndSwapUint32(&nodeConn.connFlag, 0, 1) {
-			log.Printf("nodeConn.connFlag [%d]", id)
-			conn.Close()
-			continue
-		}
+	if network.tls != nil && network.tls.verify(conn, id) != nil {
+		log.Printf("accept id %d from %s: %v", id, conn.RemoteAddr(), errPeerIdentity)
+		conn.Close()
+		return
+	}
 
-		nodeConn.conn = conn
-		nodeConn.readReader = bufio.NewReader(nodeConn.conn)
+	nodeConn := network.getNodeConn(id, false)
+	if nodeConn == nil {
+		log.Printf("nw.nodeConns2[%d] == nil", id)
+		conn.Close()
+		return
+	}
 
-		log.Printf("accept connect from %d", id)
+	if !atomic.CompareAndSwapUint32(&nodeConn.connFlag, 0, 1) {
+		log.Printf("nodeConn.connFlag [%d]", id)
+		conn.Close()
+		return
+	}
 
-		go nodeConn.acceptProcess()
+	binary.LittleEndian.PutUint32(buf[:], uint32(network.maxFrameSize))
+	_, err = conn.Write(buf[:4])
+	if err != nil {
+		log.Printf("accept id %d: write max frame size failed: %s", id, err)
+		conn.Close()
+		atomic.StoreUint32(&nodeConn.connFlag, 0)
+		return
 	}
+	conn.SetDeadline(time.Time{})
+
+	network.setPeerFrameSize(id, peerFrameSize)
+	nodeConn.peerFrameSize = peerFrameSize
+	nodeConn.conn = conn
+	nodeConn.readReader = bufio.NewReader(nodeConn.conn)
+
+	log.Printf("accept connect from %d", id)
+
+	nodeConn.acceptProcess()
 }
 
 func (network *NodeNetwork) send(id int, m message) {
-	conn := network.nodeConns1[id]
+	conn := network.getNodeConn(id, true)
 	if conn == nil {
 		return
 	}
@@ -109,7 +257,7 @@ func (network *NodeNetwork) send(id int, m message) {
 }
 
 func (network *NodeNetwork) response(id int, m message) {
-	conn := network.nodeConns2[id]
+	conn := network.getNodeConn(id, false)
 	if conn == nil {
 		return
 	}
@@ -135,16 +283,18 @@ func (network *NodeNetwork) recv(timeout time.Duration) (message, bool) {
 }
 
 type NodeConn struct {
-	id         int
-	addr       string
-	active     bool
-	conn       net.Conn
-	readReader *bufio.Reader
-	readBuf    []byte
-	sendBuf    chan message
-	connFlag   uint32
-	waitExit   sync.WaitGroup
-	network    *NodeNetwork
+	id            int
+	addr          string
+	active        bool
+	conn          net.Conn
+	readReader    *bufio.Reader
+	readBuf       []byte
+	sendBuf       chan message
+	connFlag      uint32
+	closed        uint32
+	peerFrameSize int // 对方的帧长度上限，每次建立连接时在启动收发协程之前设置
+	waitExit      sync.WaitGroup
+	network       *NodeNetwork
 }
 
 func newNodeConn(id int, addr string, active bool, network *NodeNetwork) *NodeConn {
@@ -160,8 +310,18 @@ func newNodeConn(id int, addr string, active bool, network *NodeNetwork) *NodeCo
 	return &c
 }
 
+// close 节点被移出集群时关闭连接，不再重连
+func (c *NodeConn) close() {
+	atomic.StoreUint32(&c.closed, 1)
+
+	conn := c.conn
+	if conn != nil {
+		conn.Close()
+	}
+}
+
 func (c *NodeConn) process() {
-	for {
+	for atomic.LoadUint32(&c.closed) == 0 {
 		if !c.connect() {
 			time.Sleep(time.Second)
 			continue
@@ -205,28 +365,34 @@ func (c *NodeConn) send() {
 			break
 		}
 
-		var buf [1024]byte
-		var size uint32
-		binary.LittleEndian.PutUint32(buf[:], size)
-		size += 4
+		if frameHeadSize+frameFieldsSize+len(m.acceptValue) > c.peerFrameSize {
+			log.Printf("frame too large(%d) type: %d id: %d, dropped", frameHeadSize+frameFieldsSize+len(m.acceptValue), m.typ, c.id)
+			continue
+		}
+
+		buf := make([]byte, frameHeadSize+frameFieldsSize+len(m.acceptValue))
+		var size uint32 = frameHeadSize
 		binary.LittleEndian.PutUint32(buf[size:], uint32(m.typ))
 		size += 4
 		binary.LittleEndian.PutUint32(buf[size:], uint32(m.from))
 		size += 4
+		binary.LittleEndian.PutUint32(buf[size:], uint32(m.instanceGroupID))
+		size += 4
+		binary.LittleEndian.PutUint32(buf[size:], uint32(m.seq))
+		size += 4
 		binary.LittleEndian.PutUint32(buf[size:], uint32(m.instanceID))
 		size += 4
+		binary.LittleEndian.PutUint32(buf[size:], uint32(m.endInstanceID))
+		size += 4
 		binary.LittleEndian.PutUint32(buf[size:], uint32(m.proposalBallot))
 		size += 4
 		binary.LittleEndian.PutUint32(buf[size:], uint32(m.rejectBallot))
 		size += 4
 		binary.LittleEndian.PutUint32(buf[size:], uint32(m.acceptBallot))
 		size += 4
-		val := []byte(m.acceptValue)
-		for i := range val {
-			buf[size] = val[i]
-			size++
-		}
+		size += uint32(copy(buf[size:], m.acceptValue))
 		binary.LittleEndian.PutUint32(buf[:], size)
+		binary.LittleEndian.PutUint32(buf[4:], crc32.Checksum(buf[frameHeadSize:size], frameCRCTable))
 
 		_, err := c.conn.Write(buf[:size])
 		if err != nil {
@@ -250,16 +416,23 @@ func (c *NodeConn) recv() {
 	}()
 
 	for {
-		var head [4]byte
+		var head [frameHeadSize]byte
 		_, err := io.ReadFull(c.readReader, head[:])
 		if err != nil {
 			log.Printf("io.ReadFull1 failed: %s id: %d active: %v", err, c.id, c.active)
 			break
 		}
 
-		size := binary.LittleEndian.Uint32(head[:]) - 4
+		// 长度或者校验和不对时不能再信任后面的数据，丢弃这个帧并重置连接
+		size := binary.LittleEndian.Uint32(head[:])
+		if size < frameHeadSize+frameFieldsSize || size > uint32(c.network.maxFrameSize) {
+			atomic.AddUint64(&c.network.corruptFrames, 1)
+			log.Printf("corrupt frame size(%d) id: %d, reset connection", size, c.id)
+			break
+		}
+		size -= frameHeadSize
 		if size > uint32(len(c.readBuf)) {
-			panic("size > uint32(len(c.readBuf))")
+			c.readBuf = make([]byte, size)
 		}
 
 		_, err = io.ReadFull(c.readReader, c.readBuf[:size])
@@ -268,14 +441,26 @@ func (c *NodeConn) recv() {
 			break
 		}
 
+		if crc32.Checksum(c.readBuf[:size], frameCRCTable) != binary.LittleEndian.Uint32(head[4:]) {
+			atomic.AddUint64(&c.network.corruptFrames, 1)
+			log.Printf("corrupt frame checksum id: %d, reset connection", c.id)
+			break
+		}
+
 		var n int
 		var m message
 		m.typ = int(binary.LittleEndian.Uint32(c.readBuf[n:]))
 		n += 4
 		m.from = int(binary.LittleEndian.Uint32(c.readBuf[n:]))
 		n += 4
+		m.instanceGroupID = int(binary.LittleEndian.Uint32(c.readBuf[n:]))
+		n += 4
+		m.seq = int(binary.LittleEndian.Uint32(c.readBuf[n:]))
+		n += 4
 		m.instanceID = int(binary.LittleEndian.Uint32(c.readBuf[n:]))
 		n += 4
+		m.endInstanceID = int(binary.LittleEndian.Uint32(c.readBuf[n:]))
+		n += 4
 		m.proposalBallot = int(binary.LittleEndian.Uint32(c.readBuf[n:]))
 		n += 4
 		m.rejectBallot = int(binary.LittleEndian.Uint32(c.readBuf[n:]))
@@ -289,7 +474,13 @@ func (c *NodeConn) recv() {
 }
 
 func (c *NodeConn) connect() bool {
-	conn, err := net.Dial("tcp", c.addr)
+	var conn net.Conn
+	var err error
+	if c.network.tls != nil {
+		conn, err = c.network.tls.dial(c.id, c.addr)
+	} else {
+		conn, err = net.Dial("tcp", c.addr)
+	}
 	if err != nil {
 		log.Println("re connect error ", err)
 		return false
@@ -298,8 +489,9 @@ func (c *NodeConn) connect() bool {
 	c.conn = conn
 	c.readReader = bufio.NewReader(c.conn)
 
-	var buf [4]byte
+	var buf [8]byte
 	binary.LittleEndian.PutUint32(buf[:], uint32(c.network.nodeID))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(c.network.maxFrameSize))
 	_, err = c.conn.Write(buf[:])
 	if err != nil {
 		fmt.Println("Conn.Write failed:", err)
@@ -307,6 +499,25 @@ func (c *NodeConn) connect() bool {
 		return false
 	}
 
+	// 对方接受连接以后回复它的帧长度上限
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	_, err = io.ReadFull(c.readReader, buf[:4])
+	if err != nil {
+		log.Printf("read max frame size from %d failed: %s", c.id, err)
+		conn.Close()
+		return false
+	}
+	conn.SetDeadline(time.Time{})
+
+	peerFrameSize := int(binary.LittleEndian.Uint32(buf[:]))
+	if peerFrameSize < minMaxFrameSize {
+		log.Printf("node %d max frame size(%d) too small", c.id, peerFrameSize)
+		conn.Close()
+		return false
+	}
+	c.network.setPeerFrameSize(c.id, peerFrameSize)
+	c.peerFrameSize = peerFrameSize
+
 	log.Printf("connect to %d", c.id)
 
 	return true
@@ -1,39 +1,256 @@
 package main
 
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var errCreateNetwork = errors.New("create network failed")
+
+// NodeConfig 节点配置
+type NodeConfig struct {
+	NodeID         int
+	ListenAddr     string
+	NodeAddrs      map[int]string
+	Observers      map[int]string // 只学习不投票的节点，不计入多数派
+	DataDir        string         // 为空时不持久化
+	PipelineWindow int            // 每个InstanceGroup同时进行中的instance个数上限，不超过maxPipelineWindow
+	Weights        map[int]int    // 节点的投票权重，默认为1
+	Phase1Quorum   int            // prepare阶段需要的权重，为0时使用多数派
+	Phase2Quorum   int            // accept阶段需要的权重，为0时使用多数派
+	FastPaxos      bool           // 新的instance先尝试fast round，冲突时回退到经典的prepare/accept
+	FastQuorum     int            // fast round需要的权重，为0时根据phase1计算
+	EPaxos         bool           // 普通的值走epaxos，不同key的值不需要排序
+	Witnesses      map[int]bool   // NodeAddrs中只保存值摘要的投票节点
+	TLSCAFile      string         // 三个都配置时节点之间使用双向TLS
+	TLSCertFile    string
+	TLSKeyFile     string
+	MaxFrameSize   int       // 节点之间单个帧的长度上限，为0时使用默认值，节点之间可以不同，一个值的最大长度取集群里最小的
+	Transport      Transport // 不为nil时使用它收发消息，忽略ListenAddr跟TLS配置
+	FaultInjection bool      // 允许在运行时通过管理接口注入网络故障
+
+	clock   clock // 为nil时使用系统时间
+	stepped bool  // 模拟模式，不启动任何协程，由模拟器逐步驱动
+}
+
 // Node 节点
 type Node struct {
-	nodeID         int
-	network        *NodeNetwork
-	instanceGroups map[int]*InstanceGroup
+	nodeID             int
+	network            Transport
+	nodeAddrs          map[int]string // 启动时的成员列表，之后的变更通过paxos提交
+	observers          map[int]string
+	dataDir            string
+	pipelineWindow     int
+	quorum             quorumConfig
+	fastPaxos          bool
+	epaxos             bool
+	clock              clock
+	stepped            bool
+	faults             *faultTransport // 没有开启故障注入时为nil
+	instanceGroups     map[int]*InstanceGroup
+	instanceGroupsLock sync.RWMutex // dispatch协程跟创建instanceGroup协程保护锁
 }
 
-func newNode(nodeID int, listenAddr string, nodeAddrs map[int]string) *Node {
-	network := NewNodeNetwork(nodeID, listenAddr, nodeAddrs)
-	if network == nil {
+func newNode(cfg NodeConfig) *Node {
+	quorum := quorumConfig{weights: cfg.Weights, phase1: cfg.Phase1Quorum, phase2: cfg.Phase2Quorum, fast: cfg.FastQuorum, witnesses: cfg.Witnesses}
+	err := quorum.validate(cfg.NodeAddrs)
+	if err != nil {
+		log.Printf("invalid quorum config: %v", err)
+		return nil
+	}
+	// fast round冲突恢复跟epaxos都需要从回复中拿到完整的值
+	if len(cfg.Witnesses) > 0 && (cfg.FastPaxos || cfg.EPaxos) {
+		log.Printf("witness can not be used with fast paxos or epaxos")
 		return nil
 	}
 
-	node := &Node{nodeID: nodeID, network: network}
+	allAddrs := copyNodes(cfg.NodeAddrs)
+	for k, v := range cfg.Observers {
+		allAddrs[k] = v
+	}
+
+	network, err := newTransport(cfg, allAddrs)
+	if err != nil {
+		log.Printf("create transport error: %v", err)
+		return nil
+	}
+	var faults *faultTransport
+	if cfg.FaultInjection {
+		faults = newFaultTransport(cfg.NodeID, network)
+		network = faults
+	}
+
+	node := &Node{nodeID: cfg.NodeID, network: network, nodeAddrs: cfg.NodeAddrs, observers: cfg.Observers, dataDir: cfg.DataDir, pipelineWindow: cfg.PipelineWindow, quorum: quorum, fastPaxos: cfg.FastPaxos, epaxos: cfg.EPaxos, clock: cfg.clock, stepped: cfg.stepped, faults: faults}
+	if node.pipelineWindow <= 0 {
+		node.pipelineWindow = 1
+	}
+	if node.pipelineWindow > maxPipelineWindow {
+		log.Printf("pipeline window(%d) exceeds %d, use %d", node.pipelineWindow, maxPipelineWindow, maxPipelineWindow)
+		node.pipelineWindow = maxPipelineWindow
+	}
+	if node.clock == nil {
+		node.clock = realClock{}
+	}
 	node.instanceGroups = make(map[int]*InstanceGroup)
 
+	if !node.stepped {
+		go node.dispatch()
+	}
+
 	return node
 }
 
+// newTransport 没有指定Transport时监听ListenAddr，跟其他节点建立TCP连接
+func newTransport(cfg NodeConfig, nodeAddrs map[int]string) (Transport, error) {
+	if cfg.Transport != nil {
+		for k, v := range nodeAddrs {
+			cfg.Transport.addNode(k, v)
+		}
+		return cfg.Transport, nil
+	}
+
+	var tlsConfig *peerTLS
+	if cfg.TLSCAFile != "" || cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" {
+		var err error
+		tlsConfig, err = loadPeerTLS(cfg.TLSCAFile, cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	network := NewNodeNetwork(cfg.NodeID, cfg.ListenAddr, nodeAddrs, tlsConfig, cfg.MaxFrameSize)
+	if network == nil {
+		return nil, errCreateNetwork
+	}
+
+	return network, nil
+}
+
 func (node *Node) getNodeID() int {
 	return node.nodeID
 }
 
-func (node *Node) getNodeCount() int {
-	return len(node.network.nodeAddrs)
+func (node *Node) getQuorumConfig() *quorumConfig {
+	return &node.quorum
+}
+
+func (node *Node) now() time.Time {
+	return node.clock.now()
+}
+
+// isStepped 模拟模式下消息跟定时器都由模拟器在同一个协程里驱动
+func (node *Node) isStepped() bool {
+	return node.stepped
+}
+
+func (node *Node) isFastPaxos() bool {
+	return node.fastPaxos
+}
+
+func (node *Node) isEPaxos() bool {
+	return node.epaxos
+}
+
+// isWitness 见证者只投票，acceptor只保存值的摘要，不执行状态机也不给其他节点提供学习
+func (node *Node) isWitness() bool {
+	return node.quorum.isWitness(node.nodeID)
+}
+
+// isObserver 观察者只运行learner，不参与投票也不发起提交
+func (node *Node) isObserver() bool {
+	_, ok := node.observers[node.nodeID]
+	return ok
+}
+
+func (node *Node) getBootstrapNodes() map[int]string {
+	return node.nodeAddrs
+}
+
+func (node *Node) getPipelineWindow() int {
+	return node.pipelineWindow
+}
+
+func (node *Node) getMaxValueSize() int {
+	return node.network.getMaxValueSize()
+}
+
+// getDataDir 返回instanceGroup的数据目录，未配置时返回空串，表示不持久化
+func (node *Node) getDataDir(instanceGroupID int) string {
+	if node.dataDir == "" {
+		return ""
+	}
+
+	return filepath.Join(node.dataDir, fmt.Sprintf("group_%d", instanceGroupID))
 }
 
 func (node *Node) getInstanceGroup(instanceGroupID int) *InstanceGroup {
+	node.instanceGroupsLock.RLock()
+	defer node.instanceGroupsLock.RUnlock()
+
 	return node.instanceGroups[instanceGroupID]
 }
 
 func (node *Node) newInstanceGroup(instanceGroupID int, sm statemachine) *InstanceGroup {
 	instanceGroup := newInstanceGroup(node, instanceGroupID, sm)
+	if instanceGroup == nil {
+		return nil
+	}
+
+	node.instanceGroupsLock.Lock()
 	node.instanceGroups[instanceGroupID] = instanceGroup
+	node.instanceGroupsLock.Unlock()
+
+	node.syncNetwork()
 
 	return instanceGroup
 }
+
+// syncNetwork 根据所有InstanceGroup还保留着的成员配置增删网络连接
+func (node *Node) syncNetwork() {
+	nodes := copyNodes(node.observers)
+	node.instanceGroupsLock.RLock()
+	for _, instanceGroup := range node.instanceGroups {
+		for k, v := range instanceGroup.membership.getAllNodes() {
+			nodes[k] = v
+		}
+	}
+	node.instanceGroupsLock.RUnlock()
+
+	for k, v := range nodes {
+		node.network.addNode(k, v)
+	}
+
+	for _, id := range node.network.getNodeIDs() {
+		if _, ok := nodes[id]; !ok && id != node.nodeID {
+			log.Printf("node: %d remove connection to node(%d)", node.nodeID, id)
+			node.network.removeNode(id)
+		}
+	}
+}
+
+// dispatch 把网络层收到的消息按instanceGroupID分发到对应的InstanceGroup，
+// 队列满时丢弃消息，不能让一个处理慢的InstanceGroup阻塞其他InstanceGroup，丢失的消息由paxos重试
+func (node *Node) dispatch() {
+	for {
+		m, ok := node.network.recv(time.Second)
+		if !ok {
+			continue
+		}
+
+		instanceGroup := node.getInstanceGroup(m.instanceGroupID)
+		if instanceGroup == nil {
+			log.Printf("node: %d drop message type(%d) from(%d) unknown instanceGroupID(%d)", node.nodeID, m.typ, m.from, m.instanceGroupID)
+			continue
+		}
+
+		select {
+		case instanceGroup.recvQueue <- m:
+		default:
+			log.Printf("node: %d drop message type(%d) from(%d) instanceGroupID(%d) recv queue full", node.nodeID, m.typ, m.from, m.instanceGroupID)
+		}
+	}
+}
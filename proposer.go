@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"log"
 	"sync"
@@ -15,91 +16,340 @@ const (
 )
 
 type proposerInstance struct {
-	instanceID     int
-	state          int
-	proposalBallot int
-	acceptValue    string
-	acceptBallot   int
-	counter        counter
+	instanceID       int
+	state            int
+	proposalBallot   int
+	acceptValue      string
+	acceptBallot     int
+	counter          counter
+	commitValue      string           // 本instance要提交的打包值
+	commitBatchID    string           // 打包值的ID，学习到的值是不是本instance提交的按它判断
+	commitBatch      []*commitRequest // 打包值对应的请求
+	fastValues       map[int]string   // 恢复时记录每个节点在fast round中接受的值
+	witnessBallot    int              // 见证者回复的最大acceptBallot，见证者只有值的摘要
+	acceptedMaxID    int              // 本轮accept通过的acceptor回复的各自接受过的最大instanceID
+	quorumAcceptedID int              // 经本节点的多数派选定时的acceptedMaxID，master据此决定执行到哪里之后可以直接读本地
+}
+
+// fastBallot fast round使用的ballot，小于genProposalID生成的任何ballot，冲突恢复时经典的prepare总能覆盖它
+const fastBallot = 1
+
+// fastAcceptTimeout fast多数派比经典多数派大，有节点不可用时很快回退到经典的prepare/accept
+const fastAcceptTimeout = time.Millisecond * 200
+
+const proposalBatchMaxCount = 64
+
+// proposerRetryTimeout 没有收到足够的回复时重新prepare，启动时连接（特别是TLS握手）还没建立好的消息会丢失
+const proposerRetryTimeout = time.Second * 3
+
+var (
+	errCommitTimeout  = errors.New("commit timeout")
+	errCommitCanceled = errors.New("commit canceled")
+	errValueTooLarge  = errors.New("value too large")
+	errCommitUnknown  = errors.New("commit outcome unknown")
+)
+
+// commitRequest 一个等待提交的值，结果通过result返回给commit协程
+type commitRequest struct {
+	value    string
+	result   chan string
+	err      error // 在写入result之前设置，不为nil时result没有意义
+	canceled bool  // 调用方已放弃等待，还在队列中的不再提交
 }
 
 type proposer struct {
 	sequence            int
 	multiProposalBallot int
-	commitValue         string
-	hasNewCommitValue   bool
-	commitValueLock     sync.Mutex // commit协程跟instance协程保护锁
-	waitCommitLock      sync.Mutex // 几个submit协程保护锁
-	resultChan          chan string
+	batchSeq            uint64                    // 打包值ID的序号，从启动时间开始，重启后不会跟之前的重复
+	nextInstanceID      int                       // 下一个要发起的instanceID
+	inflights           map[int]*proposerInstance // 已经发起但还没有学习到结果的instance
+	commitQueue         []*commitRequest          // 等待提交的请求
+	recoverRequested    bool                      // 读请求等待时发现学习停滞，由instance协程在下一个没有学习到的instance上重新prepare
+	commitValueLock     sync.Mutex                // commit协程跟instance协程保护锁
 	instanceGroup       *InstanceGroup
 	instances           map[int]*proposerInstance
 }
 
 func newProposer(instanceGroup *InstanceGroup) *proposer {
 	p := &proposer{sequence: 0, instanceGroup: instanceGroup}
-	p.resultChan = make(chan string)
+	p.batchSeq = uint64(instanceGroup.now().UnixNano())
 	p.instances = make(map[int]*proposerInstance)
+	p.inflights = make(map[int]*proposerInstance)
 
 	return p
 }
 
-func (p *proposer) commit(val string) (string, error) {
-	p.waitCommitLock.Lock()
-	defer p.waitCommitLock.Unlock()
+// commit 把值放入队列，instance协程会把排队的值打包到同一个instance中提交
+// ctx结束时放弃等待，还没发起的请求会从队列中移除，已经发起的请求仍可能被选定
+func (p *proposer) commit(ctx context.Context, val string) (string, error) {
+	req, err := p.submit(val)
+	if err != nil {
+		return "", err
+	}
+
+	select {
+	case result := <-req.result:
+		return result, req.err
+	case <-ctx.Done():
+		p.cancelRequest(req)
+		return "", contextError(ctx)
+	}
+}
+
+// submit 把值放入队列，不等待结果，结果会写入返回的请求
+func (p *proposer) submit(val string) (*commitRequest, error) {
+	if err := p.checkValueSize(val); err != nil {
+		return nil, err
+	}
+
+	req := &commitRequest{value: val, result: make(chan string, 1)}
 
 	p.commitValueLock.Lock()
-	p.commitValue = val
-	p.hasNewCommitValue = true
+	p.commitQueue = append(p.commitQueue, req)
 	p.commitValueLock.Unlock()
 
-	var result string
-	select {
-	case result = <-p.resultChan:
-	case <-time.After(time.Second * 500000):
-		return "", errors.New("result chan timeout")
+	return req, nil
+}
+
+// checkValueSize 值单独打包成一个batch后也要能放进一个网络帧
+func (p *proposer) checkValueSize(val string) error {
+	if 2+batchIDSize+4+len(val) > p.getMaxProposalSize() {
+		log.Printf("proposer: %d value size(%d) exceeds limit(%d)", p.instanceGroup.getNodeID(), len(val), p.getMaxProposalSize()-2-batchIDSize-4)
+		return errValueTooLarge
 	}
 
-	return result, nil
+	return nil
+}
+
+// getMaxProposalSize 提交的值的长度上限，学习者拉取回复中每个值前面还有4字节的长度
+func (p *proposer) getMaxProposalSize() int {
+	return p.instanceGroup.getMaxValueSize() - 4
 }
 
-func (p *proposer) update(init bool) {
+// cancelRequest 把放弃等待的请求从队列中移除
+func (p *proposer) cancelRequest(req *commitRequest) {
 	p.commitValueLock.Lock()
-	if init && !p.hasNewCommitValue {
-		p.commitValueLock.Unlock()
-		return
+	defer p.commitValueLock.Unlock()
+
+	req.canceled = true
+	for i, r := range p.commitQueue {
+		if r == req {
+			p.commitQueue = append(p.commitQueue[:i:i], p.commitQueue[i+1:]...)
+			break
+		}
+	}
+}
+
+// contextError 把ctx的结束原因转换成提交错误
+func contextError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return errCommitTimeout
 	}
-	p.hasNewCommitValue = false
+	return errCommitCanceled
+}
+
+// requestRecover 读请求等不到下一个instance被学习时调用。这个instance可能只被少数派接受，发起者已经不在，
+// 需要重新prepare：有接受过的值时提交它，没有时提交空值
+func (p *proposer) requestRecover() {
+	p.commitValueLock.Lock()
+	p.recoverRequested = true
+	p.commitValueLock.Unlock()
+}
+
+// recoverStalled 在下一个没有学习到的instance上发起prepare，本节点正在提交这个instance时不需要
+func (p *proposer) recoverStalled() {
+	p.commitValueLock.Lock()
+	requested := p.recoverRequested
+	p.recoverRequested = false
 	p.commitValueLock.Unlock()
 
 	instanceID := p.instanceGroup.getNextInstanceID()
+	if !requested || p.inflights[instanceID] != nil {
+		return
+	}
+
+	log.Printf("proposer: %d recover stalled instanceID(%d)", p.instanceGroup.getNodeID(), instanceID)
 	inst := &proposerInstance{instanceID: instanceID, state: proposerNone, proposalBallot: 1, acceptBallot: 0, acceptValue: ""}
-	inst.counter.nodeCount = p.instanceGroup.getNodeCount()
+	inst.counter.setMembers(p.instanceGroup.getMembers(instanceID), p.instanceGroup.getQuorumConfig())
 	p.instances[instanceID] = inst
+	p.inflights[instanceID] = inst
+	if p.nextInstanceID <= instanceID {
+		p.nextInstanceID = instanceID + 1
+	}
+	p.prepare(inst)
+}
 
-	if p.multiProposalBallot != 0 {
-		inst.proposalBallot = p.multiProposalBallot
-		p.commitValueLock.Lock()
-		inst.acceptValue = p.commitValue
-		p.commitValueLock.Unlock()
-		p.accept(inst)
-	} else {
-		p.prepare(inst)
+// update 窗口未满时从队列中取出请求，在新的instance上发起提交
+func (p *proposer) update() {
+	p.recoverStalled()
+
+	// 其他节点持有租期时acceptor只接受master发起的新instance，排队的请求交还给调用方转发给master
+	if p.isLeasedByOther() {
+		p.failQueue(errNotMaster)
+		return
+	}
+
+	for p.canPropose() {
+		batch, value, batchID := p.takeBatch()
+		if batch == nil {
+			return
+		}
+
+		if p.nextInstanceID < p.instanceGroup.getNextInstanceID() {
+			p.nextInstanceID = p.instanceGroup.getNextInstanceID()
+		}
+		instanceID := p.nextInstanceID
+		p.nextInstanceID++
+
+		inst := &proposerInstance{instanceID: instanceID, state: proposerNone, proposalBallot: 1, acceptBallot: 0, acceptValue: ""}
+		inst.counter.setMembers(p.instanceGroup.getMembers(instanceID), p.instanceGroup.getQuorumConfig())
+		inst.commitValue = value
+		inst.commitBatchID = batchID
+		inst.commitBatch = batch
+		p.instances[instanceID] = inst
+		p.inflights[instanceID] = inst
+
+		if p.multiProposalBallot != 0 {
+			inst.proposalBallot = p.multiProposalBallot
+			inst.acceptValue = inst.commitValue
+			p.accept(inst)
+		} else if p.instanceGroup.isFastPaxos() {
+			p.fastAccept(inst)
+		} else {
+			p.prepare(inst)
+		}
+	}
+}
+
+// isLeasedByOther 其他节点持有master租期，fast paxos下acceptor不限制非master的节点
+func (p *proposer) isLeasedByOther() bool {
+	if p.instanceGroup.isFastPaxos() {
+		return false
+	}
+
+	master := p.instanceGroup.master.getMaster()
+	return master != 0 && master != p.instanceGroup.getNodeID()
+}
+
+// canPropose 只有multi-paxos稳定提交时才同时发起多个instance，否则一次只发起一个
+func (p *proposer) canPropose() bool {
+	if len(p.inflights) == 0 {
+		return true
+	}
+
+	return p.multiProposalBallot != 0 && len(p.inflights) < p.instanceGroup.getPipelineWindow()
+}
+
+// takeBatch 从队列中取出一批请求打包成一个值，同时返回打包值的ID
+func (p *proposer) takeBatch() ([]*commitRequest, string, string) {
+	p.commitValueLock.Lock()
+	defer p.commitValueLock.Unlock()
+
+	if len(p.commitQueue) == 0 {
+		return nil, "", ""
+	}
+
+	var values []string
+	size := 2 + batchIDSize
+	n := 0
+	for n < len(p.commitQueue) && n < proposalBatchMaxCount {
+		size += 4 + len(p.commitQueue[n].value)
+		if n > 0 && size > p.getMaxProposalSize() {
+			break
+		}
+		values = append(values, p.commitQueue[n].value)
+		n++
+	}
+
+	batch := p.commitQueue[:n:n]
+	p.commitQueue = p.commitQueue[n:]
+
+	p.batchSeq++
+	batchID := newBatchID(p.instanceGroup.getNodeID(), p.batchSeq)
+
+	return batch, serializeBatchValue(batchID, values), batchID
+}
+
+// requeueBatch 本instance被其他值占用时，把请求放回队列头部重新提交
+func (p *proposer) requeueBatch(batch []*commitRequest) {
+	p.commitValueLock.Lock()
+	defer p.commitValueLock.Unlock()
+
+	var requeue []*commitRequest
+	for _, req := range batch {
+		if !req.canceled {
+			requeue = append(requeue, req)
+		}
+	}
+	p.commitQueue = append(requeue, p.commitQueue...)
+}
+
+// finishBatch 把打包值的执行结果拆开，分别返回给每个commit协程
+func finishBatch(batch []*commitRequest, ret string) {
+	results := unserializeBatch(ret)
+	for i, req := range batch {
+		var result string
+		if i < len(results) {
+			result = results[i]
+		}
+		req.result <- result
+	}
+}
+
+// failBatch 没有执行结果时让每个commit协程返回err
+func failBatch(batch []*commitRequest, err error) {
+	for _, req := range batch {
+		req.err = err
+		req.result <- ""
+	}
+}
+
+// failQueue 让队列中还没有发起的请求都返回err
+func (p *proposer) failQueue(err error) {
+	p.commitValueLock.Lock()
+	queue := p.commitQueue
+	p.commitQueue = nil
+	p.commitValueLock.Unlock()
+
+	failBatch(queue, err)
+}
+
+// onLearned 学习者按顺序执行完instanceID后调用，把结果返回给对应的commit协程
+func (p *proposer) onLearned(instanceID int, value string, ret string) {
+	inst := p.inflights[instanceID]
+	if inst == nil {
+		return
+	}
+
+	delete(p.inflights, instanceID)
+	p.instanceGroup.tm.delTimer(proposerTimerID(instanceID))
+
+	// 其他节点可能提交了内容完全相同的打包值，只有ID相同才是本instance的请求被执行了
+	if batchIDOf(value) == inst.commitBatchID {
+		finishBatch(inst.commitBatch, ret)
+	} else if inst.commitBatch != nil {
+		log.Printf("proposer: %d instanceID(%d) chosen other value, requeue %d requests", p.instanceGroup.getNodeID(), instanceID, len(inst.commitBatch))
+		inst.state = proposerClosen
+		p.multiProposalBallot = 0
+		p.requeueBatch(inst.commitBatch)
 	}
 }
 
 func (p *proposer) prepare(inst *proposerInstance) {
 	maxRejectN := inst.counter.getMaxRejectN()
-	inst.counter.startNewRound()
+	inst.counter.startNewRound(p.instanceGroup.getQuorumConfig().getQuorum(quorumPhase1, inst.counter.totalWeight))
 	inst.acceptBallot = 0
+	inst.witnessBallot = 0
+	inst.fastValues = make(map[int]string)
 
 	inst.proposalBallot = p.genProposalID(maxRejectN)
 	inst.state = proposerPrepareing
 
 	m := message{typ: Prepare, from: p.instanceGroup.getNodeID(), instanceID: inst.instanceID, proposalBallot: inst.proposalBallot}
-	p.instanceGroup.broadcast(m, true)
+	p.instanceGroup.broadcastTo(inst.counter.members, m)
 
-	p.instanceGroup.tm.delTimer(AcceptedTimeout)
-	p.instanceGroup.tm.addTimer(PromisedTimeout, time.Millisecond*20000000, func(int) {
+	p.instanceGroup.tm.delTimer(proposerTimerID(inst.instanceID))
+	p.instanceGroup.tm.addTimer(proposerTimerID(inst.instanceID), proposerRetryTimeout, func(int) {
 		log.Printf("proposer: %d promise timeout instanceID(%d)", p.instanceGroup.getNodeID(), inst.instanceID)
 		p.prepare(inst)
 	})
@@ -128,21 +378,28 @@ func (p *proposer) onPromised(m message) {
 		log.Printf("proposer: %d received a new promise from(%d) instanceID(%d) proposalID(%d) acceptBallot(%d) acceptValue(%s)", p.instanceGroup.getNodeID(), m.from, m.instanceID, m.proposalBallot, m.acceptBallot, m.acceptValue)
 
 		// 找到最大acceptBallot的值
-		if m.acceptBallot > inst.acceptBallot {
+		if p.instanceGroup.getQuorumConfig().isWitness(m.from) {
+			if m.acceptBallot > inst.witnessBallot {
+				inst.witnessBallot = m.acceptBallot
+			}
+		} else if m.acceptBallot > inst.acceptBallot {
 			inst.acceptBallot = m.acceptBallot
 			inst.acceptValue = m.acceptValue
 		}
+		if m.acceptBallot == fastBallot && inst.counter.isMember(m.from) {
+			inst.fastValues[m.from] = m.acceptValue
+		}
 	} else {
 		log.Printf("proposer: %d received a reject promise from(%d) instanceID(%d) proposalID(%d) rejectBallot(%d) acceptBallot(%d) acceptV(%s)", p.instanceGroup.getNodeID(), m.from, m.instanceID, m.proposalBallot, m.rejectBallot, m.acceptBallot, m.acceptValue)
 		inst.counter.addReject(m.from, m.rejectBallot)
 	}
 
-	if inst.counter.isPassedOnThisRound() {
+	if inst.counter.isPassedOnThisRound() && p.knowValue(inst) {
 		// 如果prepare阶段对应的instanceID没有冲突，就试着提交自己的value
 		if inst.acceptBallot == 0 {
-			p.commitValueLock.Lock()
-			inst.acceptValue = p.commitValue
-			p.commitValueLock.Unlock()
+			inst.acceptValue = inst.commitValue
+		} else if inst.acceptBallot == fastBallot {
+			inst.acceptValue = p.pickFastValue(inst)
 		}
 		p.accept(inst)
 	} else if inst.counter.isRejectedOnThisRound() || inst.counter.isAllReceiveOnThisRound() {
@@ -150,16 +407,68 @@ func (p *proposer) onPromised(m message) {
 	}
 }
 
+// knowValue 见证者接受过更大ballot的值时，要等所有保存完整值的成员都回复。phase2多数派一定包含
+// 保存完整值的成员，所以这个值如果被选定过，这些成员中acceptBallot最大的值就是它
+func (p *proposer) knowValue(inst *proposerInstance) bool {
+	if inst.witnessBallot <= inst.acceptBallot {
+		return true
+	}
+
+	qc := p.instanceGroup.getQuorumConfig()
+	for id := range inst.counter.members {
+		if _, ok := inst.counter.passes[id]; !ok && !qc.isWitness(id) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// pickFastValue fast round冲突后选择要提交的值。fast round中可能被选定的值在本轮承诺中的权重
+// 至少是 fast - (总权重 - 已承诺权重)，phase1跟任意两个fast多数派相交保证这样的值最多一个，没有的话可以提交自己的值
+func (p *proposer) pickFastValue(inst *proposerInstance) string {
+	qc := p.instanceGroup.getQuorumConfig()
+	need := qc.getQuorum(quorumFast, inst.counter.totalWeight) - (inst.counter.totalWeight - inst.counter.getPassWeight())
+
+	votes := make(map[string]int)
+	for id, value := range inst.fastValues {
+		votes[value] += qc.getWeight(id)
+	}
+	for value, weight := range votes {
+		if weight >= need {
+			return value
+		}
+	}
+
+	return inst.commitValue
+}
+
+// fastAccept 跳过prepare直接用fastBallot发起accept，fast多数派接受了同一个值才算选定，
+// 其他proposer同时提交造成冲突时由accept的拒绝触发经典的prepare进行恢复
+func (p *proposer) fastAccept(inst *proposerInstance) {
+	inst.proposalBallot = fastBallot
+	inst.acceptBallot = 0
+	inst.acceptValue = inst.commitValue
+	p.accept(inst)
+}
+
 func (p *proposer) accept(inst *proposerInstance) {
-	inst.counter.startNewRound()
+	phase := quorumPhase2
+	timeout := proposerRetryTimeout
+	if inst.proposalBallot == fastBallot {
+		phase = quorumFast
+		timeout = fastAcceptTimeout
+	}
+	inst.counter.startNewRound(p.instanceGroup.getQuorumConfig().getQuorum(phase, inst.counter.totalWeight))
+	inst.acceptedMaxID = 0
 
 	m := message{typ: Propose, from: p.instanceGroup.getNodeID(), instanceID: inst.instanceID, proposalBallot: inst.proposalBallot, acceptValue: inst.acceptValue}
-	p.instanceGroup.broadcast(m, true)
+	p.instanceGroup.broadcastTo(inst.counter.members, m)
 
 	inst.state = proposerAccepting
 
-	p.instanceGroup.tm.delTimer(PromisedTimeout)
-	p.instanceGroup.tm.addTimer(AcceptedTimeout, time.Millisecond*20000000, func(int) {
+	p.instanceGroup.tm.delTimer(proposerTimerID(inst.instanceID))
+	p.instanceGroup.tm.addTimer(proposerTimerID(inst.instanceID), timeout, func(int) {
 		log.Printf("proposer: %d accept timeout instanceID(%d)", p.instanceGroup.getNodeID(), inst.instanceID)
 		p.prepare(inst)
 	})
@@ -184,6 +493,9 @@ func (p *proposer) onAccepted(msg message) {
 
 	if msg.rejectBallot == 0 {
 		inst.counter.addPass(msg.from)
+		if msg.endInstanceID > inst.acceptedMaxID {
+			inst.acceptedMaxID = msg.endInstanceID
+		}
 		log.Printf("proposer: %d received a new accept from(%d) instanceID(%d) proposalID(%d) acceptBallot(%d) acceptValue(%s)", p.instanceGroup.getNodeID(), msg.from, msg.instanceID, msg.proposalBallot, msg.acceptBallot, msg.acceptValue)
 	} else {
 		inst.counter.addReject(msg.from, msg.rejectBallot)
@@ -192,25 +504,55 @@ func (p *proposer) onAccepted(msg message) {
 
 	if inst.counter.isPassedOnThisRound() {
 		inst.state = proposerClosen
-		p.instanceGroup.tm.delTimer(AcceptedTimeout)
-		ret := p.instanceGroup.learner.onValueClosed(inst.instanceID, inst.acceptValue)
+		inst.quorumAcceptedID = inst.acceptedMaxID
+		p.instanceGroup.tm.delTimer(proposerTimerID(inst.instanceID))
 
 		log.Printf("proposer: %d closen value instanceID(%d) acceptBallot(%d) acceptValue(%s)\n", p.instanceGroup.getNodeID(), inst.instanceID, inst.acceptBallot, inst.acceptValue)
-		if inst.acceptBallot == 0 {
-			p.commitValueLock.Lock()
-			p.resultChan <- ret
-			p.commitValueLock.Unlock()
+		// fast paxos每个新的instance都走fast round，不保留multi-paxos的ballot
+		if inst.acceptBallot == 0 && !p.instanceGroup.isFastPaxos() {
 			p.multiProposalBallot = inst.proposalBallot
 		} else {
 			p.multiProposalBallot = 0
-			p.update(false)
 		}
 
+		// 结果由学习者按顺序执行后通过onLearned返回，不是自己的值时会把请求放回队列
+		p.instanceGroup.learner.onValueClosed(inst.instanceID, inst.acceptValue)
+
 	} else if inst.counter.isRejectedOnThisRound() || inst.counter.isAllReceiveOnThisRound() {
+		p.multiProposalBallot = 0
 		p.prepare(inst)
 	}
 }
 
+// getQuorumAcceptedID 返回选定instanceID的多数派在接受时各自接受过的最大instanceID，
+// 不是经本节点的多数派选定时返回0
+func (p *proposer) getQuorumAcceptedID(instanceID int) int {
+	inst := p.instances[instanceID]
+	if inst == nil {
+		return 0
+	}
+
+	return inst.quorumAcceptedID
+}
+
+// compact 删除instanceID及之前的proposer状态
+func (p *proposer) compact(instanceID int) {
+	for k := range p.instances {
+		if k <= instanceID {
+			delete(p.instances, k)
+		}
+	}
+
+	// 安装了其他节点的快照，这些instance的结果已经无法得知，值仍然可能已经被选定，调用方需要重新确认
+	for k, inst := range p.inflights {
+		if k <= instanceID {
+			delete(p.inflights, k)
+			p.instanceGroup.tm.delTimer(proposerTimerID(k))
+			failBatch(inst.commitBatch, errCommitUnknown)
+		}
+	}
+}
+
 func (p *proposer) genProposalID(maxRejectN int) int {
 	sequence := maxRejectN >> 16
 	if sequence < p.sequence {
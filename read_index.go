@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const readIndexTimeout = time.Second * 3
+
+// readIndexRecoverInterval 等待执行到readIndex时，下一个instance这么久还没有学习到就请求proposer恢复它
+const readIndexRecoverInterval = time.Millisecond * 500
+
+var errReadIndexTimeout = errors.New("read index timeout")
+
+type readIndexRound struct {
+	counter   counter
+	readIndex int
+	done      chan int
+}
+
+// readIndex 向多数派询问已接受或已学习的最大instanceID，任何已经完成的写一定不大于这个位置，
+// 本地执行到这个位置之后读状态机就是线性一致的。已接受的instance不一定会被选定，
+// 等待时停滞的instance交给proposer重新prepare
+type readIndex struct {
+	instanceGroup *InstanceGroup
+	lock          sync.Mutex // 读协程跟instance协程保护锁
+	seq           int
+	rounds        map[int]*readIndexRound
+}
+
+func newReadIndex(instanceGroup *InstanceGroup) *readIndex {
+	r := &readIndex{instanceGroup: instanceGroup}
+	r.rounds = make(map[int]*readIndexRound)
+
+	return r
+}
+
+// wait 获取readIndex并等待本地执行到那里
+func (r *readIndex) wait(ctx context.Context) error {
+	waitCtx, cancel := context.WithTimeout(ctx, readIndexTimeout)
+	defer cancel()
+
+	r.lock.Lock()
+	r.seq++
+	seq := r.seq
+	round := &readIndexRound{done: make(chan int, 1)}
+	members := r.instanceGroup.getMembers(r.instanceGroup.getAppliedInstanceID() + 1)
+	round.counter.setMembers(members, r.instanceGroup.getQuorumConfig())
+	round.counter.startNewRound(r.instanceGroup.getQuorumConfig().getQuorum(quorumRead, round.counter.totalWeight))
+	r.rounds[seq] = round
+	r.lock.Unlock()
+
+	defer func() {
+		r.lock.Lock()
+		delete(r.rounds, seq)
+		r.lock.Unlock()
+	}()
+
+	m := message{typ: ReadIndexRequest, from: r.instanceGroup.getNodeID(), seq: seq}
+	r.instanceGroup.broadcastTo(members, m)
+
+	var index int
+	select {
+	case index = <-round.done:
+	case <-waitCtx.Done():
+		return waitError(ctx)
+	}
+
+	applied := r.instanceGroup.getAppliedInstanceID()
+	stallTime := time.Now()
+	for applied < index {
+		select {
+		case <-waitCtx.Done():
+			log.Printf("readIndex: %d wait apply timeout readIndex(%d) applied(%d)", r.instanceGroup.getNodeID(), index, applied)
+			return waitError(ctx)
+		case <-time.After(time.Millisecond):
+		}
+
+		if now := r.instanceGroup.getAppliedInstanceID(); now != applied {
+			applied = now
+			stallTime = time.Now()
+		} else if time.Since(stallTime) >= readIndexRecoverInterval && r.canRecover() {
+			r.instanceGroup.proposer.requestRecover()
+			stallTime = time.Now()
+		}
+	}
+
+	return nil
+}
+
+// canRecover 观察者跟见证者不发起提交
+func (r *readIndex) canRecover() bool {
+	return !r.instanceGroup.node.isObserver() && !r.instanceGroup.node.isWitness()
+}
+
+// waitError 调用方的ctx结束时返回提交错误，否则是readIndex自身超时
+func waitError(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return contextError(ctx)
+	}
+	return errReadIndexTimeout
+}
+
+func (r *readIndex) onReadIndexRequest(msg message) {
+	index := r.instanceGroup.acceptor.maxAcceptedID
+	if applied := r.instanceGroup.getAppliedInstanceID(); applied > index {
+		index = applied
+	}
+
+	m := message{typ: ReadIndexResponse, from: r.instanceGroup.getNodeID(), seq: msg.seq, instanceID: index}
+	r.instanceGroup.response(msg.from, m)
+}
+
+func (r *readIndex) onReadIndexResponse(m message) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	round := r.rounds[m.seq]
+	if round == nil {
+		return
+	}
+
+	round.counter.addPass(m.from)
+	if m.instanceID > round.readIndex {
+		round.readIndex = m.instanceID
+	}
+
+	if round.counter.isPassedOnThisRound() {
+		round.done <- round.readIndex
+		delete(r.rounds, m.seq)
+	}
+}
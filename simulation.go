@@ -0,0 +1,592 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// simTick 虚拟时间每一步前进的长度，消息至少延迟一步投递
+const simTick = time.Millisecond
+
+// simSettleTimeout 故障阶段结束后恢复网络，等待所有提交完成的虚拟时长上限
+const simSettleTimeout = time.Minute
+
+// SimulationConfig 模拟的参数，种子相同时整个执行过程完全一样
+type SimulationConfig struct {
+	Seed           int64
+	Nodes          int
+	PipelineWindow int
+	Commits        int           // 客户端发起的提交个数，随机分布在故障阶段，随机选择节点提交
+	Duration       time.Duration // 注入故障的虚拟时长
+	MaxDelay       time.Duration // 每个消息额外的随机延迟上限，不同的延迟造成乱序
+	DropRate       float64       // 消息丢弃的概率
+	DupRate        float64       // 消息重复投递的概率
+	IsolateRate    float64       // 每秒隔离一个节点的概率，隔离持续不超过两个租期
+	CrashRate      float64       // 每秒让一个节点崩溃的概率，停机不超过两个租期后从数据目录重启，需要配置DataDir
+	DataDir        string        // 每个节点在下面使用自己的子目录，为空时不持久化
+	Verbose        bool          // 输出每个消息的投递过程
+}
+
+// SimulationResult 模拟的结果，Err不为nil时用同样的配置跟Seed可以重放
+type SimulationResult struct {
+	Seed      int64
+	Elapsed   time.Duration // 虚拟时长
+	Delivered int
+	Dropped   int
+	Committed int
+	Crashed   int
+	Digest    uint64 // 投递过的消息序列的摘要，重放时应该一样
+	Err       error
+}
+
+type simMessage struct {
+	to        int
+	deliverAt time.Time
+	m         message
+}
+
+// simNode 模拟中的一个节点，所有节点在模拟器的协程里依次运行
+type simNode struct {
+	id            int
+	instanceGroup *InstanceGroup
+	sm            *simStatemachine
+	isolatedUntil time.Time
+	downUntil     time.Time
+	checked       int // 已经跟chosen核对过的状态机日志长度
+}
+
+// Simulation 确定性模拟：用虚拟时钟代替系统时间，消息的投递顺序、延迟、丢弃跟重复都由种子决定，
+// 每一步之后检查所有节点执行的值是同一个序列的前缀
+type Simulation struct {
+	cfg       SimulationConfig
+	rand      *rand.Rand
+	clock     *virtualClock
+	start     time.Time
+	nodes     []*simNode
+	pending   []simMessage
+	outbox    []simMessage // 一次处理中发出的消息，处理完后排序再决定延迟，避免依赖map的遍历顺序
+	addrs     map[int]string
+	isolated  map[int]bool
+	down      map[int]bool // 崩溃后还没有重启的节点，不运行也不收消息
+	requests  []*commitRequest
+	owners    []int          // 每个提交交给的节点，节点崩溃时它上面未完成的提交随之失败
+	chosen    []string       // 所有节点执行过的值的最长序列
+	executed  map[string]int // 执行过的值在chosen中的位置
+	result    SimulationResult
+	digest    hash.Hash64
+	nextCheck time.Time
+}
+
+func NewSimulation(cfg SimulationConfig) *Simulation {
+	if cfg.Nodes <= 0 {
+		cfg.Nodes = 3
+	}
+	// 没有持久化的节点重启后会忘记投过的票，崩溃只能在有数据目录时注入
+	if cfg.CrashRate > 0 && cfg.DataDir == "" {
+		log.Printf("simulation: crash rate requires data dir")
+		return nil
+	}
+
+	sim := &Simulation{cfg: cfg, rand: rand.New(rand.NewSource(cfg.Seed)), clock: newVirtualClock()}
+	sim.start = sim.clock.now()
+	sim.isolated = make(map[int]bool)
+	sim.down = make(map[int]bool)
+	sim.executed = make(map[string]int)
+	sim.digest = fnv.New64a()
+	sim.result.Seed = cfg.Seed
+
+	sim.addrs = make(map[int]string)
+	for id := 1; id <= cfg.Nodes; id++ {
+		sim.addrs[id] = fmt.Sprintf("sim-%d", id)
+	}
+
+	for id := 1; id <= cfg.Nodes; id++ {
+		n := &simNode{id: id}
+		if !sim.startNode(n) {
+			return nil
+		}
+		sim.nodes = append(sim.nodes, n)
+	}
+	sim.flush()
+
+	return sim
+}
+
+// startNode 创建节点，配置了DataDir时从节点的数据目录恢复，崩溃后重启也走这里
+func (sim *Simulation) startNode(n *simNode) bool {
+	dataDir := ""
+	if sim.cfg.DataDir != "" {
+		dataDir = filepath.Join(sim.cfg.DataDir, fmt.Sprintf("node_%d", n.id))
+	}
+
+	transport := &simTransport{sim: sim, nodeID: n.id, nodeAddrs: make(map[int]string)}
+	nodeCfg := NodeConfig{NodeID: n.id, NodeAddrs: sim.addrs, DataDir: dataDir, PipelineWindow: sim.cfg.PipelineWindow, Transport: transport, clock: sim.clock, stepped: true}
+	node := newNode(nodeCfg)
+	if node == nil {
+		return false
+	}
+
+	sm := &simStatemachine{}
+	instanceGroup := node.newInstanceGroup(0, sm)
+	if instanceGroup == nil {
+		return false
+	}
+	n.instanceGroup = instanceGroup
+	n.sm = sm
+	// 重启后状态机从快照跟日志重建，从头跟chosen核对
+	n.checked = 0
+
+	return true
+}
+
+// Run 运行故障阶段，然后恢复网络直到所有提交完成，出现不一致或者超时时返回错误
+func (sim *Simulation) Run() SimulationResult {
+	commitTimes := make([]time.Duration, sim.cfg.Commits)
+	for i := range commitTimes {
+		commitTimes[i] = time.Duration(sim.rand.Int63n(int64(sim.cfg.Duration) + 1))
+	}
+	sort.Slice(commitTimes, func(i, j int) bool { return commitTimes[i] < commitTimes[j] })
+
+	faultEnd := sim.start.Add(sim.cfg.Duration)
+	deadline := faultEnd.Add(simSettleTimeout)
+	for {
+		now := sim.clock.now()
+		sim.updateIsolation(now, now.Before(faultEnd))
+		if err := sim.updateCrash(now, now.Before(faultEnd)); err != nil {
+			return sim.finish(err)
+		}
+
+		for len(sim.requests) < len(commitTimes) && !sim.start.Add(commitTimes[len(sim.requests)]).After(now) {
+			sim.requests = append(sim.requests, nil)
+			sim.owners = append(sim.owners, 0)
+			sim.submit(len(sim.requests) - 1)
+		}
+		sim.resubmit()
+
+		sim.deliver(now)
+
+		for _, n := range sim.nodes {
+			if sim.down[n.id] {
+				continue
+			}
+			n.instanceGroup.tick()
+			sim.flush()
+		}
+		if !now.Before(sim.nextCheck) {
+			for _, n := range sim.nodes {
+				if sim.down[n.id] {
+					continue
+				}
+				n.instanceGroup.master.step()
+				sim.flush()
+			}
+			sim.nextCheck = now.Add(masterCheckInterval)
+		}
+
+		if err := sim.checkSafety(); err != nil {
+			return sim.finish(err)
+		}
+
+		if !now.Before(faultEnd) && sim.countCommitted() == len(commitTimes) {
+			return sim.finish(nil)
+		}
+		if !now.Before(deadline) {
+			return sim.finish(fmt.Errorf("%d of %d commits not finished after %v", len(commitTimes)-sim.countCommitted(), len(commitTimes), now.Sub(sim.start)))
+		}
+
+		sim.clock.advance(simTick)
+	}
+}
+
+func (sim *Simulation) finish(err error) SimulationResult {
+	sim.result.Elapsed = sim.clock.now().Sub(sim.start)
+	sim.result.Committed = sim.countCommitted()
+	sim.result.Digest = sim.digest.Sum64()
+	sim.result.Err = err
+
+	return sim.result
+}
+
+// submit 随机选一个节点交给proposer，节点知道其他节点持有租期时像转发一样改交给master，
+// 没有master时多个节点同时提交会互相抢占
+func (sim *Simulation) submit(i int) {
+	n := sim.nodes[sim.rand.Intn(len(sim.nodes))]
+	if !sim.down[n.id] {
+		if master := n.instanceGroup.master.getMaster(); master != 0 && !sim.down[master] {
+			n = sim.nodes[master-1]
+		}
+	}
+
+	var req *commitRequest
+	if !sim.down[n.id] {
+		req, _ = n.instanceGroup.proposer.submit(fmt.Sprintf("c%d", i))
+	}
+	if req == nil {
+		// 节点已经崩溃，提交没有发起
+		req = &commitRequest{result: make(chan string, 1), err: errCommitCanceled}
+		req.result <- ""
+	}
+	sim.requests[i] = req
+	sim.owners[i] = n.id
+	sim.trace("client commit c%d to node(%d)", i, n.id)
+}
+
+// resubmit 排队时其他节点成为了master的请求没有发起过，重新提交
+func (sim *Simulation) resubmit() {
+	for i, req := range sim.requests {
+		if len(req.result) > 0 && req.err == errNotMaster {
+			sim.submit(i)
+		}
+	}
+}
+
+func (sim *Simulation) countCommitted() int {
+	count := 0
+	for _, req := range sim.requests {
+		if len(req.result) > 0 {
+			count++
+		}
+	}
+
+	return count
+}
+
+// updateIsolation 故障阶段随机隔离节点，被隔离的节点照常运行，只是收发的消息都会丢失
+func (sim *Simulation) updateIsolation(now time.Time, faulty bool) {
+	for _, n := range sim.nodes {
+		if sim.isolated[n.id] && (!faulty || !now.Before(n.isolatedUntil)) {
+			delete(sim.isolated, n.id)
+			sim.trace("node(%d) rejoin", n.id)
+		}
+	}
+
+	if !faulty || sim.cfg.IsolateRate <= 0 {
+		return
+	}
+	if sim.rand.Float64() >= sim.cfg.IsolateRate*float64(simTick)/float64(time.Second) {
+		return
+	}
+
+	n := sim.nodes[sim.rand.Intn(len(sim.nodes))]
+	if sim.isolated[n.id] {
+		return
+	}
+	sim.isolated[n.id] = true
+	n.isolatedUntil = now.Add(time.Duration(sim.rand.Int63n(int64(2 * masterLeaseTime))))
+	sim.trace("node(%d) isolated until %v", n.id, n.isolatedUntil.Sub(sim.start))
+}
+
+// updateCrash 故障阶段随机让节点崩溃，崩溃的节点关闭日志后丢掉全部内存状态，到期后从数据目录重启，
+// 交给它还没有完成的提交结果未知，值仍然可能被选定
+func (sim *Simulation) updateCrash(now time.Time, faulty bool) error {
+	for _, n := range sim.nodes {
+		if sim.down[n.id] && (!faulty || !now.Before(n.downUntil)) {
+			if !sim.startNode(n) {
+				return fmt.Errorf("node(%d) restart from %s failed", n.id, sim.cfg.DataDir)
+			}
+			delete(sim.down, n.id)
+			sim.flush()
+			sim.trace("node(%d) restart", n.id)
+		}
+	}
+
+	if !faulty || sim.cfg.CrashRate <= 0 {
+		return nil
+	}
+	if sim.rand.Float64() >= sim.cfg.CrashRate*float64(simTick)/float64(time.Second) {
+		return nil
+	}
+
+	n := sim.nodes[sim.rand.Intn(len(sim.nodes))]
+	if sim.down[n.id] {
+		return nil
+	}
+	n.instanceGroup.close()
+	for i, req := range sim.requests {
+		if sim.owners[i] == n.id && len(req.result) == 0 {
+			req.err = errCommitUnknown
+			req.result <- ""
+		}
+	}
+	sim.down[n.id] = true
+	n.downUntil = now.Add(time.Duration(sim.rand.Int63n(int64(2 * masterLeaseTime))))
+	sim.result.Crashed++
+	sim.trace("node(%d) crashed until %v", n.id, n.downUntil.Sub(sim.start))
+
+	return nil
+}
+
+// deliver 投递所有到期的消息，先按内容排序再由种子决定投递顺序
+func (sim *Simulation) deliver(now time.Time) {
+	var due, rest []simMessage
+	for _, sm := range sim.pending {
+		if sm.deliverAt.After(now) {
+			rest = append(rest, sm)
+		} else {
+			due = append(due, sm)
+		}
+	}
+	sim.pending = rest
+
+	sortSimMessages(due)
+	for _, i := range sim.rand.Perm(len(due)) {
+		sm := due[i]
+		if sim.isolated[sm.to] || sim.isolated[sm.m.from] || sim.down[sm.to] {
+			sim.result.Dropped++
+			continue
+		}
+
+		sim.result.Delivered++
+		sim.hashMessage(sm)
+		sim.trace("deliver type(%d) from(%d) to(%d) instanceID(%d) ballot(%d)", sm.m.typ, sm.m.from, sm.to, sm.m.instanceID, sm.m.proposalBallot)
+
+		sim.nodes[sm.to-1].instanceGroup.handleMessage(sm.m)
+		sim.flush()
+	}
+}
+
+// flush 给刚发出的消息决定丢弃、重复跟延迟
+func (sim *Simulation) flush() {
+	outbox := sim.outbox
+	sim.outbox = nil
+
+	sortSimMessages(outbox)
+	now := sim.clock.now()
+	for _, sm := range outbox {
+		if sim.isolated[sm.to] || sim.isolated[sm.m.from] || sim.rand.Float64() < sim.cfg.DropRate {
+			sim.result.Dropped++
+			continue
+		}
+
+		copies := 1
+		if sim.rand.Float64() < sim.cfg.DupRate {
+			copies = 2
+		}
+		for i := 0; i < copies; i++ {
+			sm.deliverAt = now.Add(simTick + time.Duration(sim.rand.Int63n(int64(sim.cfg.MaxDelay)+1)))
+			sim.pending = append(sim.pending, sm)
+		}
+	}
+}
+
+// checkSafety 所有节点的状态机执行的值都要是同一个序列的前缀，每个值最多执行一次
+func (sim *Simulation) checkSafety() error {
+	for _, n := range sim.nodes {
+		values := n.sm.values
+		if len(values) < n.checked {
+			// 安装的快照只会比已执行的更新
+			return fmt.Errorf("node(%d) state machine went back from %d to %d values", n.id, n.checked, len(values))
+		}
+
+		for i := n.checked; i < len(values); i++ {
+			if i < len(sim.chosen) {
+				if values[i] != sim.chosen[i] {
+					return fmt.Errorf("node(%d) executed %q at %d, other node executed %q", n.id, values[i], i, sim.chosen[i])
+				}
+				continue
+			}
+
+			if _, ok := sim.executed[values[i]]; ok {
+				return fmt.Errorf("node(%d) executed %q twice", n.id, values[i])
+			}
+			if !strings.HasPrefix(values[i], "c") {
+				return fmt.Errorf("node(%d) executed unknown value %q", n.id, values[i])
+			}
+			sim.executed[values[i]] = len(sim.chosen)
+			sim.chosen = append(sim.chosen, values[i])
+		}
+		n.checked = len(values)
+	}
+
+	return sim.checkLeaseRead()
+}
+
+// checkLeaseRead 可以直接读本地的master，状态机里必须已经有所有返回了成功的提交
+func (sim *Simulation) checkLeaseRead() error {
+	for _, n := range sim.nodes {
+		if sim.down[n.id] || !n.instanceGroup.canReadLocal() {
+			continue
+		}
+
+		for i, req := range sim.requests {
+			if len(req.result) == 0 || req.err != nil {
+				continue
+			}
+			value := fmt.Sprintf("c%d", i)
+			if pos, ok := sim.executed[value]; !ok || pos >= len(n.sm.values) {
+				return fmt.Errorf("node(%d) reads locally in lease without committed %q", n.id, value)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (sim *Simulation) hashMessage(sm simMessage) {
+	var buf [44]byte
+	binary.LittleEndian.PutUint32(buf[0:], uint32(sm.to))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(sm.m.typ))
+	binary.LittleEndian.PutUint32(buf[8:], uint32(sm.m.from))
+	binary.LittleEndian.PutUint32(buf[12:], uint32(sm.m.instanceGroupID))
+	binary.LittleEndian.PutUint32(buf[16:], uint32(sm.m.seq))
+	binary.LittleEndian.PutUint32(buf[20:], uint32(sm.m.instanceID))
+	binary.LittleEndian.PutUint32(buf[24:], uint32(sm.m.endInstanceID))
+	binary.LittleEndian.PutUint32(buf[28:], uint32(sm.m.proposalBallot))
+	binary.LittleEndian.PutUint32(buf[32:], uint32(sm.m.rejectBallot))
+	binary.LittleEndian.PutUint32(buf[36:], uint32(sm.m.acceptBallot))
+	binary.LittleEndian.PutUint32(buf[40:], uint32(len(sm.m.acceptValue)))
+	sim.digest.Write(buf[:])
+	sim.digest.Write([]byte(sm.m.acceptValue))
+}
+
+func (sim *Simulation) trace(format string, args ...interface{}) {
+	if sim.cfg.Verbose {
+		log.Printf("sim: t=%v %s", sim.clock.now().Sub(sim.start), fmt.Sprintf(format, args...))
+	}
+}
+
+// sortSimMessages 按内容排序，内容完全相同的消息谁先谁后没有区别
+func sortSimMessages(msgs []simMessage) {
+	sort.SliceStable(msgs, func(i, j int) bool {
+		a, b := msgs[i], msgs[j]
+		if a.to != b.to {
+			return a.to < b.to
+		}
+		fa := [...]int{a.m.from, a.m.typ, a.m.instanceGroupID, a.m.instanceID, a.m.endInstanceID, a.m.seq, a.m.proposalBallot, a.m.rejectBallot, a.m.acceptBallot}
+		fb := [...]int{b.m.from, b.m.typ, b.m.instanceGroupID, b.m.instanceID, b.m.endInstanceID, b.m.seq, b.m.proposalBallot, b.m.rejectBallot, b.m.acceptBallot}
+		for k := range fa {
+			if fa[k] != fb[k] {
+				return fa[k] < fb[k]
+			}
+		}
+		if a.m.acceptValue != b.m.acceptValue {
+			return a.m.acceptValue < b.m.acceptValue
+		}
+		return a.deliverAt.Before(b.deliverAt)
+	})
+}
+
+// runSimulations 从cfg.Seed开始依次运行runs次模拟，有失败时打印重放用的种子
+func runSimulations(cfg SimulationConfig, runs int) bool {
+	if cfg.Seed == 0 {
+		cfg.Seed = time.Now().UnixNano()
+	}
+
+	// 各个角色的日志量很大，只在需要时输出，虚拟时间跟系统时间无关，不输出时间戳
+	log.SetFlags(0)
+	if !cfg.Verbose {
+		log.SetOutput(ioutil.Discard)
+		defer log.SetOutput(os.Stderr)
+	}
+
+	ok := true
+	for i := 0; i < runs; i++ {
+		result := runSimulation(cfg)
+		fmt.Printf("seed %d: elapsed(%v) delivered(%d) dropped(%d) committed(%d) crashed(%d) digest(%016x)\n", result.Seed, result.Elapsed, result.Delivered, result.Dropped, result.Committed, result.Crashed, result.Digest)
+		if result.Err != nil {
+			fmt.Printf("seed %d: FAILED: %v, replay with -simulate -runs 1 -seed %d\n", result.Seed, result.Err, result.Seed)
+			ok = false
+		}
+		cfg.Seed++
+	}
+
+	return ok
+}
+
+// runSimulation 运行一次模拟，注入崩溃而没有指定DataDir时使用临时目录，结束后删除
+func runSimulation(cfg SimulationConfig) SimulationResult {
+	if cfg.CrashRate > 0 && cfg.DataDir == "" {
+		dir, err := ioutil.TempDir("", "paxos-sim")
+		if err != nil {
+			return SimulationResult{Seed: cfg.Seed, Err: err}
+		}
+		defer os.RemoveAll(dir)
+		cfg.DataDir = dir
+	}
+
+	sim := NewSimulation(cfg)
+	if sim == nil {
+		return SimulationResult{Seed: cfg.Seed, Err: errors.New("create simulation failed")}
+	}
+
+	return sim.Run()
+}
+
+// simTransport 模拟中节点的Transport，发出的消息交给模拟器决定什么时候投递
+type simTransport struct {
+	sim       *Simulation
+	nodeID    int
+	nodeAddrs map[int]string
+}
+
+func (t *simTransport) send(id int, m message) {
+	if _, ok := t.nodeAddrs[id]; !ok {
+		return
+	}
+	t.sim.outbox = append(t.sim.outbox, simMessage{to: id, m: m})
+}
+
+func (t *simTransport) response(id int, m message) {
+	t.send(id, m)
+}
+
+func (t *simTransport) recv(timeout time.Duration) (message, bool) {
+	return message{}, false
+}
+
+func (t *simTransport) addNode(id int, addr string) {
+	t.nodeAddrs[id] = addr
+}
+
+func (t *simTransport) removeNode(id int) {
+	delete(t.nodeAddrs, id)
+}
+
+func (t *simTransport) getNodeIDs() []int {
+	ids := make([]int, 0, len(t.nodeAddrs))
+	for id := range t.nodeAddrs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	return ids
+}
+
+func (t *simTransport) getMaxValueSize() int {
+	return defaultMaxFrameSize - frameHeadSize - frameFieldsSize
+}
+
+// simStatemachine 按顺序记录执行过的值，快照就是整个序列
+type simStatemachine struct {
+	values []string
+}
+
+func (sm *simStatemachine) exec(value string) string {
+	sm.values = append(sm.values, value)
+	return value
+}
+
+func (sm *simStatemachine) snapshot(instanceGroupID int) string {
+	return serializeBatch(sm.values)
+}
+
+func (sm *simStatemachine) restore(instanceGroupID int, snapshot string) error {
+	values := unserializeBatch(snapshot)
+	if serializeBatch(values) != snapshot {
+		return errBadSnapshot
+	}
+	sm.values = values
+
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	snapshotInterval      = time.Second * 10
+	snapshotChunkHeadSize = 12
+	snapshotChunkMaxSize  = 1 << 20 // 每块还要能放进一个网络帧
+)
+
+var errBadSnapshot = errors.New("bad snapshot")
+
+// saveSnapshot 保存状态机快照，格式为 instanceID(4) + crc32(4) + data
+func saveSnapshot(path string, instanceID int, data string) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 8+len(data))
+	binary.LittleEndian.PutUint32(buf[0:], uint32(instanceID))
+	binary.LittleEndian.PutUint32(buf[4:], crc32.ChecksumIEEE([]byte(data)))
+	copy(buf[8:], data)
+
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(buf)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+// loadSnapshot 读取状态机快照，快照不存在时返回instanceID为0
+func loadSnapshot(path string) (int, string, error) {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, "", nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	if len(buf) < 8 {
+		return 0, "", errors.New("snapshot too short")
+	}
+
+	data := buf[8:]
+	if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(buf[4:]) {
+		return 0, "", errors.New("snapshot crc mismatch")
+	}
+
+	return int(binary.LittleEndian.Uint32(buf[0:])), string(data), nil
+}
+
+// snapshotChunk 快照分块，crc是整个快照的校验和，收齐之后校验
+type snapshotChunk struct {
+	offset int
+	total  int
+	crc    uint32
+	data   string
+}
+
+// serializeSnapshotChunk 快照分块的格式为 offset(4) + total(4) + crc32(4) + data
+func serializeSnapshotChunk(chunk snapshotChunk) string {
+	buf := make([]byte, snapshotChunkHeadSize+len(chunk.data))
+	binary.LittleEndian.PutUint32(buf[0:], uint32(chunk.offset))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(chunk.total))
+	binary.LittleEndian.PutUint32(buf[8:], chunk.crc)
+	copy(buf[snapshotChunkHeadSize:], chunk.data)
+
+	return string(buf)
+}
+
+func unserializeSnapshotChunk(value string) (snapshotChunk, error) {
+	buf := []byte(value)
+	if len(buf) < snapshotChunkHeadSize {
+		return snapshotChunk{}, errBadSnapshot
+	}
+
+	var chunk snapshotChunk
+	chunk.offset = int(binary.LittleEndian.Uint32(buf[0:]))
+	chunk.total = int(binary.LittleEndian.Uint32(buf[4:]))
+	chunk.crc = binary.LittleEndian.Uint32(buf[8:])
+	chunk.data = string(buf[snapshotChunkHeadSize:])
+	if chunk.offset+len(chunk.data) > chunk.total {
+		return snapshotChunk{}, errBadSnapshot
+	}
+
+	return chunk, nil
+}
+
+// serializeSnapshot 快照数据的格式为 systemSize(4) + system + statemachine
+func serializeSnapshot(system string, sm string) string {
+	var head [4]byte
+	binary.LittleEndian.PutUint32(head[:], uint32(len(system)))
+
+	return string(head[:]) + system + sm
+}
+
+func unserializeSnapshot(data string) (string, string, error) {
+	if len(data) < 4 {
+		return "", "", errBadSnapshot
+	}
+
+	size := int(binary.LittleEndian.Uint32([]byte(data[:4])))
+	if len(data)-4 < size {
+		return "", "", errBadSnapshot
+	}
+
+	return data[4 : 4+size], data[4+size:], nil
+}
@@ -2,4 +2,8 @@ package main
 
 type statemachine interface {
 	exec(value string) string
+	// snapshot 导出instanceGroup对应的状态机数据
+	snapshot(instanceGroupID int) string
+	// restore 用快照替换instanceGroup对应的状态机数据，快照格式不对时返回错误并且不修改状态机
+	restore(instanceGroupID int, snapshot string) error
 }
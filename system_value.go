@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// 系统值由paxos自身使用，不会交给状态机执行，格式为 0(1) + 类型(1) + data
+const systemValueMark byte = 0
+
+const (
+	systemMaster int = iota + 1
+	systemBatch
+	systemMembership
+)
+
+func isSystemValue(value string) bool {
+	return len(value) >= 2 && value[0] == systemValueMark
+}
+
+func serializeSystemValue(typ int, data string) string {
+	return string([]byte{systemValueMark, byte(typ)}) + data
+}
+
+func unserializeSystemValue(value string) (int, string) {
+	return int(value[1]), value[2:]
+}
+
+// serializeSystemState 快照中系统状态的格式为 [type(4) size(4) data]...，按type排序
+func serializeSystemState(states map[int]string) string {
+	types := make([]int, 0, len(states))
+	for typ := range states {
+		types = append(types, typ)
+	}
+	sort.Ints(types)
+
+	var buf []byte
+	var field [4]byte
+	for _, typ := range types {
+		data := states[typ]
+		binary.LittleEndian.PutUint32(field[:], uint32(typ))
+		buf = append(buf, field[:]...)
+		binary.LittleEndian.PutUint32(field[:], uint32(len(data)))
+		buf = append(buf, field[:]...)
+		buf = append(buf, data...)
+	}
+
+	return string(buf)
+}
+
+func unserializeSystemState(value string) (map[int]string, error) {
+	states := make(map[int]string)
+	buf := []byte(value)
+	for len(buf) > 0 {
+		if len(buf) < 8 {
+			return nil, errBadSnapshot
+		}
+		typ := int(binary.LittleEndian.Uint32(buf[0:]))
+		size := binary.LittleEndian.Uint32(buf[4:])
+		if uint32(len(buf)-8) < size {
+			return nil, errBadSnapshot
+		}
+		states[typ] = string(buf[8 : 8+size])
+		buf = buf[8+size:]
+	}
+
+	return states, nil
+}
+
+// batchIDSize 打包值前面的ID长度，格式为 nodeID(4) + seq(8)
+const batchIDSize = 12
+
+// newBatchID 生成打包值的ID，不同的proposer提交内容完全相同的打包值时据此区分
+func newBatchID(nodeID int, seq uint64) string {
+	var buf [batchIDSize]byte
+	binary.LittleEndian.PutUint32(buf[0:], uint32(nodeID))
+	binary.LittleEndian.PutUint64(buf[4:], seq)
+
+	return string(buf[:])
+}
+
+// serializeBatchValue 打包提交的系统值，data格式为 id(12) + batch
+func serializeBatchValue(id string, values []string) string {
+	return serializeSystemValue(systemBatch, id+serializeBatch(values))
+}
+
+// unserializeBatchData 拆开打包值的data，返回ID跟打包的值
+func unserializeBatchData(data string) (string, []string) {
+	if len(data) < batchIDSize {
+		return "", nil
+	}
+
+	return data[:batchIDSize], unserializeBatch(data[batchIDSize:])
+}
+
+// batchIDOf 返回打包值的ID，不是打包值时返回空串
+func batchIDOf(value string) string {
+	if !isSystemValue(value) {
+		return ""
+	}
+
+	typ, data := unserializeSystemValue(value)
+	if typ != systemBatch {
+		return ""
+	}
+	id, _ := unserializeBatchData(data)
+
+	return id
+}
+
+// serializeBatch 把多个值打包成一个，格式为 [size(4) value]...
+func serializeBatch(values []string) string {
+	var buf []byte
+	var head [4]byte
+	for _, value := range values {
+		binary.LittleEndian.PutUint32(head[:], uint32(len(value)))
+		buf = append(buf, head[:]...)
+		buf = append(buf, value...)
+	}
+
+	return string(buf)
+}
+
+func unserializeBatch(value string) []string {
+	var values []string
+	buf := []byte(value)
+	for len(buf) >= 4 {
+		size := binary.LittleEndian.Uint32(buf)
+		if uint32(len(buf)-4) < size {
+			break
+		}
+		values = append(values, string(buf[4:4+size]))
+		buf = buf[4+size:]
+	}
+
+	return values
+}
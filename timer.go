@@ -1,6 +1,9 @@
 package main
 
-import "time"
+import (
+	"sort"
+	"time"
+)
 
 type timer struct {
 	id      int
@@ -9,14 +12,15 @@ type timer struct {
 }
 
 type timerMgr struct {
+	clock     clock
 	ts        map[int]timer
 	updateing bool
 	updateAdd []timer
 	updateDel []int
 }
 
-func newTimerMgr() *timerMgr {
-	tm := timerMgr{}
+func newTimerMgr(c clock) *timerMgr {
+	tm := timerMgr{clock: c}
 	tm.ts = make(map[int]timer)
 
 	return &tm
@@ -24,9 +28,9 @@ func newTimerMgr() *timerMgr {
 
 func (t *timerMgr) addTimer(id int, timeout time.Duration, f func(int)) {
 	if !t.updateing {
-		t.ts[id] = timer{id: id, timeout: time.Now().Add(timeout), f: f}
+		t.ts[id] = timer{id: id, timeout: t.clock.now().Add(timeout), f: f}
 	} else {
-		t.updateAdd = append(t.updateAdd, timer{id: id, timeout: time.Now().Add(timeout), f: f})
+		t.updateAdd = append(t.updateAdd, timer{id: id, timeout: t.clock.now().Add(timeout), f: f})
 	}
 }
 
@@ -38,14 +42,26 @@ func (t *timerMgr) delTimer(id int) {
 	}
 }
 
+// update 按超时时间的先后调用到期的定时器，时间相同时按id，模拟时同样的输入得到同样的顺序
 func (t *timerMgr) update() {
-	now := time.Now()
-	t.updateing = true
-	for k, v := range t.ts {
+	now := t.clock.now()
+	var expired []timer
+	for _, v := range t.ts {
 		if now.After(v.timeout) {
-			v.f(k)
-			t.updateDel = append(t.updateDel, k)
+			expired = append(expired, v)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		if !expired[i].timeout.Equal(expired[j].timeout) {
+			return expired[i].timeout.Before(expired[j].timeout)
 		}
+		return expired[i].id < expired[j].id
+	})
+
+	t.updateing = true
+	for _, v := range expired {
+		v.f(v.id)
+		t.updateDel = append(t.updateDel, v.id)
 	}
 	t.updateing = false
 
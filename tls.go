@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// tlsHandshakeTimeout 握手跟读取节点ID的超时，避免慢连接阻塞accept协程
+const tlsHandshakeTimeout = time.Second * 5
+
+var errPeerIdentity = errors.New("peer certificate does not match node id")
+
+// peerTLS 节点之间的双向TLS配置，证书的DNS SAN必须是 node-<ID>，
+// 握手中声明的节点ID要跟对方证书的身份一致
+type peerTLS struct {
+	server *tls.Config
+	client *tls.Config
+}
+
+func peerIdentity(id int) string {
+	return fmt.Sprintf("node-%d", id)
+}
+
+func loadPeerTLS(caFile string, certFile string, keyFile string) (*peerTLS, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+
+	t := &peerTLS{}
+	t.server = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+	t.client = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	return t, nil
+}
+
+// dial 连接节点id，校验对方证书的身份是这个节点
+func (t *peerTLS) dial(id int, addr string) (net.Conn, error) {
+	config := t.client.Clone()
+	config.ServerName = peerIdentity(id)
+
+	dialer := &net.Dialer{Timeout: tlsHandshakeTimeout}
+	return tls.DialWithDialer(dialer, "tcp", addr, config)
+}
+
+// verify 被动接受的连接在握手之后，校验对方证书的身份跟声明的节点ID一致
+func (t *peerTLS) verify(conn net.Conn, id int) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return errPeerIdentity
+	}
+
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 || certs[0].VerifyHostname(peerIdentity(id)) != nil {
+		return errPeerIdentity
+	}
+
+	return nil
+}
@@ -0,0 +1,21 @@
+package main
+
+import "time"
+
+// Transport 节点之间收发消息的接口，paxos的各个角色只通过它通信。
+// NodeNetwork 是基于TCP的实现，MemoryNetwork 让同一个进程里的多个节点直接通过channel通信
+type Transport interface {
+	// send 发给节点id，可能丢失，不保证送达
+	send(id int, m message)
+	// response 回复节点id发来的请求，可以跟send走不同的连接
+	response(id int, m message)
+	// recv 取出发给本节点的下一个消息，超时返回false
+	recv(timeout time.Duration) (message, bool)
+	// addNode 成员变更后增加可以通信的节点
+	addNode(id int, addr string)
+	// removeNode 成员变更后删除节点，之后发给它的消息直接丢弃
+	removeNode(id int)
+	getNodeIDs() []int
+	// getMaxValueSize 一个消息里acceptValue的长度上限
+	getMaxValueSize() int
+}
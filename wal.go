@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+var errBadWALRecord = errors.New("bad wal record")
+
+// wal 预写日志，每条记录格式为 size(4) + crc32(4) + data
+type wal struct {
+	path string
+	file *os.File
+}
+
+func openWAL(path string) (*wal, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &wal{path: path, file: file}, nil
+}
+
+// replay 从头读取所有记录，末尾写了一半的记录会被截掉。
+// 校验失败的记录后面还有数据说明文件损坏，截掉会丢失之后的承诺，返回错误拒绝启动。
+// f返回错误表示校验通过的记录无法解析，这不是写了一半造成的，停止重放并返回错误
+func (w *wal) replay(f func(data []byte) error) error {
+	info, err := w.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(w.file)
+	var offset int64
+	for {
+		var head [8]byte
+		_, err = io.ReadFull(reader, head[:])
+		if err != nil {
+			break
+		}
+
+		// 长度在校验之前读取，不能信任，超过文件剩余长度的记录一直延伸到文件末尾，跟写了一半的记录一样处理
+		size := binary.LittleEndian.Uint32(head[:])
+		if int64(size) > info.Size()-offset-int64(len(head)) {
+			err = errors.New("record size exceeds file")
+			break
+		}
+		data := make([]byte, size)
+		_, err = io.ReadFull(reader, data)
+		if err != nil {
+			break
+		}
+
+		if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(head[4:]) {
+			// 只有最后一次写入可能写了一半
+			if offset+int64(len(head))+int64(size) < info.Size() {
+				log.Printf("wal: %s crc mismatch at offset(%d) before end of file(%d)", w.path, offset, info.Size())
+				return errBadWALRecord
+			}
+			err = errors.New("crc mismatch")
+			break
+		}
+
+		err = f(data)
+		if err != nil {
+			return err
+		}
+		offset += int64(len(head)) + int64(size)
+	}
+
+	if err != io.EOF {
+		log.Printf("wal: %s truncate at offset(%d): %v", w.path, offset, err)
+		if err = w.file.Truncate(offset); err != nil {
+			return err
+		}
+	}
+
+	_, err = w.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+// append 写入一条记录，返回前保证已经落盘
+func (w *wal) append(data []byte) error {
+	_, err := w.file.Write(encodeWALRecord(data))
+	if err != nil {
+		return err
+	}
+
+	return w.file.Sync()
+}
+
+func (w *wal) close() error {
+	return w.file.Close()
+}
+
+// rewrite 用records替换日志中的全部内容，先写临时文件再rename，保证崩溃时不会丢失旧日志
+func (w *wal) rewrite(records [][]byte) error {
+	tmpPath := w.path + ".tmp"
+	tmp, err := openWAL(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	err = tmp.file.Truncate(0)
+	if err != nil {
+		tmp.close()
+		return err
+	}
+
+	for _, data := range records {
+		_, err = tmp.file.Write(encodeWALRecord(data))
+		if err != nil {
+			tmp.close()
+			return err
+		}
+	}
+
+	err = tmp.file.Sync()
+	if err != nil {
+		tmp.close()
+		return err
+	}
+
+	err = os.Rename(tmpPath, w.path)
+	if err != nil {
+		tmp.close()
+		return err
+	}
+
+	w.file.Close()
+	w.file = tmp.file
+
+	return syncDir(filepath.Dir(w.path))
+}
+
+func encodeWALRecord(data []byte) []byte {
+	buf := make([]byte, 8+len(data))
+	binary.LittleEndian.PutUint32(buf[:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(data))
+	copy(buf[8:], data)
+
+	return buf
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestWAL 写入三条记录，返回文件路径跟每条记录的起始位置
+func writeTestWAL(t *testing.T) (string, []int64) {
+	path := filepath.Join(t.TempDir(), "test.wal")
+	w, err := openWAL(path)
+	if err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+
+	var offsets []int64
+	var offset int64
+	for _, s := range []string{"first", "second", "third"} {
+		offsets = append(offsets, offset)
+		if err := w.append([]byte(s)); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+		offset += int64(8 + len(s))
+	}
+	w.close()
+
+	return path, offsets
+}
+
+func corruptByte(t *testing.T, path string, offset int64) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer f.Close()
+
+	var b [1]byte
+	if _, err := f.ReadAt(b[:], offset); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	b[0] ^= 0xff
+	if _, err := f.WriteAt(b[:], offset); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+}
+
+func replayTestWAL(t *testing.T, path string) ([]string, error) {
+	w, err := openWAL(path)
+	if err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+	defer w.close()
+
+	var records []string
+	err = w.replay(func(data []byte) error {
+		records = append(records, string(data))
+		return nil
+	})
+
+	return records, err
+}
+
+// TestWALTruncateTornTail 最后一条记录校验失败是写了一半，截掉后继续使用
+func TestWALTruncateTornTail(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	path, offsets := writeTestWAL(t)
+	corruptByte(t, path, offsets[2]+8)
+
+	records, err := replayTestWAL(t, path)
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("replayed %d records, want 2", len(records))
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if info.Size() != offsets[2] {
+		t.Fatalf("file size %d after replay, want %d", info.Size(), offsets[2])
+	}
+}
+
+// TestWALRejectCorruptRecord 中间的记录校验失败时不能截掉后面的记录
+func TestWALRejectCorruptRecord(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	path, offsets := writeTestWAL(t)
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	corruptByte(t, path, offsets[1]+8)
+
+	if _, err := replayTestWAL(t, path); err != errBadWALRecord {
+		t.Fatalf("replay error %v, want %v", err, errBadWALRecord)
+	}
+
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if after.Size() != before.Size() {
+		t.Fatalf("file truncated from %d to %d", before.Size(), after.Size())
+	}
+}